@@ -0,0 +1,47 @@
+"""An example plan for a Django project. Each method boots one node of
+zeus.json or runs one command; everything a node imports is inherited
+by its children, and reloaded when the files change."""
+
+import os
+import sys
+
+import zeus
+
+
+class CustomPlan(zeus.Plan):
+    def boot(self):
+        os.environ.setdefault("DJANGO_SETTINGS_MODULE", "mysite.settings")
+        import django  # noqa: F401
+
+    def default_bundle(self):
+        import django
+        django.setup()
+
+    def development_environment(self):
+        pass
+
+    def test_environment(self):
+        import pytest  # noqa: F401
+
+    def after_fork(self):
+        # Connections opened before the fork can't be shared with the
+        # children.
+        from django.db import connections
+        connections.close_all()
+
+    def shell(self):
+        self.manage("shell")
+
+    def runserver(self):
+        self.manage("runserver")
+
+    def manage(self, *command):
+        from django.core.management import execute_from_command_line
+        execute_from_command_line(["manage.py", *command, *sys.argv[1:]])
+
+    def test(self):
+        import pytest
+        sys.exit(pytest.main(sys.argv[1:]))
+
+
+zeus.plan = CustomPlan()
@@ -3,10 +3,12 @@ module github.com/burke/zeus
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/burke/ttyutils v0.0.0-20160630170808-5017fbbf251a
 	github.com/creack/pty v1.1.17 // indirect
 	github.com/fsnotify/fsevents v0.1.2-0.20220119201631-66dfb655983d
 	github.com/fsnotify/fsnotify v1.5.1
 	github.com/kr/pty v1.1.8
 	golang.org/x/sys v0.0.0-20220209214540-3681064d5158 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,13 +1,16 @@
 package clienthandler
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/burke/zeus/go/messages"
 	"github.com/burke/zeus/go/processtree"
@@ -16,8 +19,9 @@ import (
 	"github.com/burke/zeus/go/zerror"
 )
 
-// Start boosts the process tree.
-func Start(tree *processtree.ProcessTree, done chan bool) chan bool {
+// Start boosts the process tree. A client asking the master to stop is
+// reported on stop.
+func Start(tree *processtree.ProcessTree, done chan bool, stop chan<- bool) chan bool {
 	quit := make(chan bool)
 	go func() {
 		path, _ := filepath.Abs(unixsocket.ZeusSockName())
@@ -49,7 +53,7 @@ func Start(tree *processtree.ProcessTree, done chan bool) chan bool {
 				done <- true
 				return
 			case conn := <-connections:
-				go handleClientConnection(tree, conn)
+				go handleClientConnection(tree, conn, stop)
 			}
 		}
 	}()
@@ -57,22 +61,29 @@ func Start(tree *processtree.ProcessTree, done chan bool) chan bool {
 }
 
 // see docs/client_master_handshake.md
-func handleClientConnection(tree *processtree.ProcessTree, usock *unixsocket.Usock) {
+func handleClientConnection(tree *processtree.ProcessTree, usock *unixsocket.Usock, stop chan<- bool) {
 	defer usock.Close()
 	// we have established first contact to the client.
 
-	command, clientPid, argCount, argFD, err := receiveCommandArgumentsAndPid(usock, nil)
+	codec, msg, err := messages.Accept(usock)
+	var control messages.Control
+	if err == nil && codec.Decode(msg, &control) == nil {
+		handleControlRequest(tree, usock, &control, stop)
+		return
+	}
+
+	command, clientPid, argCount, argFD, err := receiveCommandArgumentsAndPid(usock, codec, msg, err)
+	cwd, env, err := receiveEnvironment(usock, codec, tree, err)
 	commandNode, slaveNode, err := findCommandAndSlaveNodes(tree, command, err)
 	if err != nil {
 		// connection was established, no data was sent. Ignore.
 		return
 	}
-	command = commandNode.Name // resolve aliases
 
 	clientFile, err := receiveTTY(usock, err)
 
 	if err == nil && slaveNode.Error != "" {
-		writeStacktrace(usock, slaveNode, clientFile)
+		writeStacktrace(usock, codec, slaveNode, clientFile)
 		return
 	}
 	defer clientFile.Close()
@@ -80,35 +91,40 @@ func handleClientConnection(tree *processtree.ProcessTree, usock *unixsocket.Uso
 	stderrFile, err := receiveTTY(usock, err)
 
 	if err == nil && slaveNode.Error != "" {
-		writeStacktrace(usock, slaveNode, clientFile)
+		writeStacktrace(usock, codec, slaveNode, clientFile)
 		return
 	}
 	defer stderrFile.Close()
 
-	commandUsock, err := bootNewCommand(slaveNode, command, err)
-	if err != nil {
+	commandUsock, commandCodec, err := bootNewCommand(usock, slaveNode, commandNode, tree.CommandTimeout, err)
+	if err == errClientDisconnected {
+		return
+	} else if err == errCommandBootTimeout {
+		writeError(usock, codec, fmt.Sprintf("Timed out after %v waiting for %s to boot.\n", tree.CommandTimeout, slaveNode.Name), clientFile)
+		return
+	} else if err != nil {
 		// If a client connects while the command is just
 		// booting up, it actually makes it here - still
 		// expects a backtrace, of course.
-		writeStacktrace(usock, slaveNode, clientFile)
+		writeStacktrace(usock, codec, slaveNode, clientFile)
 		return
 	}
 	defer commandUsock.Close()
 
-	err = sendClientPidAndArgumentsToCommand(commandUsock, clientPid, argCount, argFD, err)
+	err = sendClientPidAndArgumentsToCommand(commandUsock, commandCodec, clientPid, argCount, argFD, cwd, env, err)
 
 	// send stdout to use
 	err = sendTTYToCommand(commandUsock, clientFile, err)
 	// send stderr to use
 	err = sendTTYToCommand(commandUsock, stderrFile, err)
 
-	cmdPid, err := receivePidFromCommand(commandUsock, err)
+	cmdPid, err := receivePidFromCommand(commandUsock, commandCodec, err)
 
-	err = sendCommandPidToClient(usock, cmdPid, err)
+	err = sendCommandPidToClient(usock, codec, cmdPid, err)
 
-	exitStatus, err := receiveExitStatus(commandUsock, err)
+	exitStatus, err := receiveExitStatus(commandUsock, commandCodec, err)
 
-	err = sendExitStatus(usock, exitStatus, err)
+	err = sendExitStatus(usock, codec, exitStatus, err)
 
 	if err != nil {
 		slog.Error(err)
@@ -116,14 +132,18 @@ func handleClientConnection(tree *processtree.ProcessTree, usock *unixsocket.Uso
 	// Done! Hooray!
 }
 
-func writeStacktrace(usock *unixsocket.Usock, slaveNode *processtree.SlaveNode, clientFile io.Writer) {
+func writeStacktrace(usock *unixsocket.Usock, codec messages.Codec, slaveNode *processtree.SlaveNode, clientFile io.Writer) {
+	writeError(usock, codec, slaveNode.Error, clientFile)
+}
+
+func writeError(usock *unixsocket.Usock, codec messages.Codec, msg string, clientFile io.Writer) {
 	// Fake process ID / output / error codes:
 	// Write a fake pid (step 6)
-	usock.WriteMessage("0")
+	messages.Send(usock, codec, &messages.CommandPid{Pid: 0})
 	// Write the error message to the terminal
-	clientFile.Write([]byte(slaveNode.Error))
+	clientFile.Write([]byte(msg))
 	// Write a non-positive exit code to the client
-	usock.WriteMessage("1")
+	messages.Send(usock, codec, &messages.ExitStatus{Code: 1})
 }
 
 func receiveFileFromFD(usock *unixsocket.Usock) (*os.File, error) {
@@ -135,23 +155,45 @@ func receiveFileFromFD(usock *unixsocket.Usock) (*os.File, error) {
 	return os.NewFile(uintptr(clientFd), fileName), nil
 }
 
-func receiveCommandArgumentsAndPid(usock *unixsocket.Usock, err error) (string, int, int, int, error) {
+func receiveCommandArgumentsAndPid(usock *unixsocket.Usock, codec messages.Codec, msg string, err error) (string, int, int, int, error) {
 	if err != nil {
 		return "", -1, -1, -1, err
 	}
 
-	msg, err := usock.ReadMessage()
-	if err != nil {
+	var request messages.CommandRequest
+	if err := codec.Decode(msg, &request); err != nil {
 		return "", -1, -1, -1, err
 	}
 
-	argCount, clientPid, command, err := messages.ParseClientCommandRequestMessage(msg)
+	argFD, err := usock.ReadFD()
+	return request.Command, request.Pid, request.ArgCount, argFD, err
+}
+
+// receiveEnvironment reads the client's working directory and
+// environment, keeping only the variables the config allows through.
+func receiveEnvironment(usock *unixsocket.Usock, codec messages.Codec, tree *processtree.ProcessTree, err error) (string, map[string]string, error) {
 	if err != nil {
-		return "", -1, -1, -1, err
+		return "", nil, err
 	}
 
-	argFD, err := usock.ReadFD()
-	return command, clientPid, argCount, argFD, err
+	var clientEnv messages.ClientEnvironment
+	if err := messages.Receive(usock, codec, &clientEnv); err != nil {
+		return "", nil, err
+	}
+
+	tree.L.RLock()
+	patterns := tree.ClientEnv
+	tree.L.RUnlock()
+
+	// The client only sends what its copy of the config allows, but
+	// it may be out of date, or an older client that sends everything.
+	env := make(map[string]string)
+	for key, value := range clientEnv.Env {
+		if processtree.ClientEnvAllowed(patterns, key) {
+			env[key] = value
+		}
+	}
+	return clientEnv.Cwd, env, nil
 }
 
 func findCommandAndSlaveNodes(tree *processtree.ProcessTree, command string, err error) (*processtree.CommandNode, *processtree.SlaveNode, error) {
@@ -175,77 +217,124 @@ func receiveTTY(usock *unixsocket.Usock, err error) (*os.File, error) {
 	return receiveFileFromFD(usock)
 }
 
-func sendClientPidAndArgumentsToCommand(commandUsock *unixsocket.Usock, clientPid int, argCount int, argFD int, err error) error {
+func sendClientPidAndArgumentsToCommand(commandUsock *unixsocket.Usock, codec messages.Codec, clientPid int, argCount int, argFD int, cwd string, env map[string]string, err error) error {
 	if err != nil {
 		return err
 	}
 
-	msg := messages.CreatePidAndArgumentsMessage(clientPid, argCount)
-	_, err = commandUsock.WriteMessage(msg)
-	if err != nil {
+	msg := &messages.PidAndArguments{Pid: clientPid, ArgCount: argCount, Cwd: cwd, Env: env}
+	if err := messages.Send(commandUsock, codec, msg); err != nil {
 		return err
 	}
 
 	return commandUsock.WriteFD(argFD)
 }
 
-func receiveExitStatus(commandUsock *unixsocket.Usock, err error) (string, error) {
+func receiveExitStatus(commandUsock *unixsocket.Usock, codec messages.Codec, err error) (int, error) {
 	if err != nil {
-		return "", err
+		return -1, err
 	}
 
-	return commandUsock.ReadMessage()
+	var status messages.ExitStatus
+	if err := messages.Receive(commandUsock, codec, &status); err != nil {
+		return -1, err
+	}
+	return status.Code, nil
 }
 
-func sendExitStatus(usock *unixsocket.Usock, exitStatus string, err error) error {
+func sendExitStatus(usock *unixsocket.Usock, codec messages.Codec, exitStatus int, err error) error {
 	if err != nil {
 		return err
 	}
 
-	_, err = usock.WriteMessage(exitStatus)
-	return err
+	return messages.Send(usock, codec, &messages.ExitStatus{Code: exitStatus})
 }
 
-func receivePidFromCommand(commandUsock *unixsocket.Usock, err error) (int, error) {
+func receivePidFromCommand(commandUsock *unixsocket.Usock, codec messages.Codec, err error) (int, error) {
 	if err != nil {
 		return -1, err
 	}
 
-	msg, err := commandUsock.ReadMessage()
-	if err != nil {
+	var pid messages.Pid
+	if err := messages.Receive(commandUsock, codec, &pid); err != nil {
 		return -1, err
 	}
-	intPid, _, _, _ := messages.ParsePidMessage(msg)
-
-	return intPid, err
+	return pid.Pid, nil
 }
 
-func sendCommandPidToClient(usock *unixsocket.Usock, pid int, err error) error {
+func sendCommandPidToClient(usock *unixsocket.Usock, codec messages.Codec, pid int, err error) error {
 	if err != nil {
 		return err
 	}
 
-	strPid := strconv.Itoa(pid)
-	_, err = usock.WriteMessage(strPid)
-
-	return err
+	return messages.Send(usock, codec, &messages.CommandPid{Pid: pid})
 }
 
-func bootNewCommand(slaveNode *processtree.SlaveNode, command string, err error) (*unixsocket.Usock, error) {
+var (
+	errClientDisconnected = errors.New("Client disconnected while waiting for command to boot")
+	errCommandBootTimeout = errors.New("Timed out waiting for command to boot")
+)
+
+func bootNewCommand(usock *unixsocket.Usock, slaveNode *processtree.SlaveNode, command *processtree.CommandNode, timeout time.Duration, err error) (*unixsocket.Usock, messages.Codec, error) {
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	request := &processtree.CommandRequest{Name: command, Retchan: make(chan *processtree.CommandReply)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, timeout)
+		defer cancelTimeout()
+	}
+
+	stopWatching := watchForDisconnect(usock, cancel)
+	request := &processtree.CommandRequest{Name: command.Name, Env: command.Env, Retchan: make(chan *processtree.CommandReply), Context: ctx}
 	slaveNode.RequestCommandBoot(request)
-	reply := <-request.Retchan // TODO: don't really want to wait indefinitely.
-	// defer commandFile.Close() // TODO: can't do this here anymore.
 
+	var reply *processtree.CommandReply
+	select {
+	case reply = <-request.Retchan:
+	case <-ctx.Done():
+	}
+	disconnected := stopWatching()
+
+	if reply == nil {
+		if disconnected {
+			return nil, nil, errClientDisconnected
+		}
+		return nil, nil, errCommandBootTimeout
+	}
 	if reply.State == processtree.SCrashed {
-		return nil, errors.New("Process has crashed")
+		return nil, nil, errors.New("Process has crashed")
 	}
 
-	return unixsocket.NewFromFile(reply.File)
+	commandUsock, err := unixsocket.NewFromFile(reply.File)
+	return commandUsock, reply.Codec, err
+}
+
+// watchForDisconnect calls disconnect if the client goes away. The
+// client sends nothing while it waits for its command to boot, so a read
+// only returns once the connection is closed. The returned function
+// stops watching and reports whether the client disconnected.
+func watchForDisconnect(usock *unixsocket.Usock, disconnect func()) func() bool {
+	result := make(chan bool, 1)
+	go func() {
+		_, err := usock.ReadMessage()
+		netErr, ok := err.(net.Error)
+		timedOut := ok && netErr.Timeout()
+		if !timedOut {
+			disconnect()
+		}
+		result <- !timedOut
+	}()
+
+	return func() bool {
+		usock.SetReadDeadline(time.Now())
+		disconnected := <-result
+		usock.SetReadDeadline(time.Time{})
+		return disconnected
+	}
 }
 
 func sendTTYToCommand(commandUsock *unixsocket.Usock, clientFile *os.File, err error) error {
@@ -0,0 +1,82 @@
+package clienthandler
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/processtree"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+// clientPair returns the master's end of a connection to a client, and
+// the client's.
+func clientPair(t *testing.T) (*unixsocket.Usock, *os.File) {
+	local, remote, err := unixsocket.Socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usock, err := unixsocket.NewFromFile(local)
+	local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		usock.Close()
+		remote.Close()
+	})
+	return usock, remote
+}
+
+// unbootedCommand returns a command whose node never boots: nothing
+// runs the node, so its requests are never answered.
+func unbootedCommand() (*processtree.SlaveNode, *processtree.CommandNode) {
+	tree := &processtree.ProcessTree{SlavesByName: make(map[string]*processtree.SlaveNode)}
+	node := tree.NewSlaveNode("boot", nil, nil)
+	tree.Root = node
+	return node, tree.NewCommandNode("test", nil, node)
+}
+
+func TestBootNewCommandStopsWhenClientDisconnects(t *testing.T) {
+	node, command := unbootedCommand()
+	usock, client := clientPair(t)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		client.Close()
+	}()
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := bootNewCommand(usock, node, command, 0, nil)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != errClientDisconnected {
+			t.Errorf("expected %v, got %v", errClientDisconnected, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to end when the client disconnected")
+	}
+}
+
+func TestBootNewCommandTimesOut(t *testing.T) {
+	node, command := unbootedCommand()
+	usock, _ := clientPair(t)
+
+	start := time.Now()
+	_, _, err := bootNewCommand(usock, node, command, 100*time.Millisecond, nil)
+	if err != errCommandBootTimeout {
+		t.Errorf("expected %v, got %v", errCommandBootTimeout, err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("expected to wait out the timeout, but gave up after %v", waited)
+	}
+
+	// The client is still connected, and can be told about the timeout.
+	if _, err := usock.WriteMessage("ping"); err != nil {
+		t.Errorf("expected the client's connection to still work, got %v", err)
+	}
+}
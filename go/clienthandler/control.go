@@ -0,0 +1,142 @@
+package clienthandler
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/processtree"
+	slog "github.com/burke/zeus/go/shinylog"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+// handleControlRequest services a client that wants to query or drive
+// the master rather than run a command.
+func handleControlRequest(tree *processtree.ProcessTree, usock *unixsocket.Usock, request *messages.Control, stop chan<- bool) {
+	op, args := request.Op, request.Args
+
+	var err error
+	switch op {
+	case messages.ControlStatus:
+		err = writeJSON(usock, tree.Status())
+	case messages.ControlWait:
+		err = handleWaitRequest(tree, usock, args)
+	case messages.ControlRestart:
+		err = handleRestartRequest(tree, usock, args)
+	case messages.ControlStop:
+		slog.Trace("stopping on client request")
+		_, err = usock.WriteMessage("OK")
+		// Don't block if a stop is already pending.
+		select {
+		case stop <- true:
+		default:
+		}
+	default:
+		_, err = usock.WriteMessage("ERROR: Unknown control request: " + op)
+	}
+
+	if err != nil {
+		slog.Error(err)
+	}
+}
+
+func writeJSON(usock *unixsocket.Usock, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = usock.WriteMessage(string(data))
+	return err
+}
+
+// handleRestartRequest restarts a single node. As with a file change,
+// the node's descendants are restarted along with it.
+func handleRestartRequest(tree *processtree.ProcessTree, usock *unixsocket.Usock, args []string) error {
+	var name string
+	if len(args) > 0 {
+		name = args[0]
+	}
+	var slave *processtree.SlaveNode
+	if name != "" {
+		slave = tree.FindSlaveByName(name)
+	}
+	if slave == nil {
+		_, err := usock.WriteMessage("ERROR: Node not found!: " + name)
+		return err
+	}
+
+	slog.Trace("restarting %s on client request", name)
+	slave.RequestRestart()
+	_, err := usock.WriteMessage("OK")
+	return err
+}
+
+// handleWaitRequest blocks until the requested node (or the node a
+// requested command runs in) is ready or crashed, then replies with its
+// status. With no target, it waits for every node in the tree.
+func handleWaitRequest(tree *processtree.ProcessTree, usock *unixsocket.Usock, args []string) error {
+	targets, err := findWaitTargets(tree, args)
+	if err != nil {
+		_, err = usock.WriteMessage(err.Error())
+		return err
+	}
+
+	sub := tree.Subscribe()
+	defer sub.Close()
+
+	// The client sends nothing more, so a read only returns once it
+	// has gone away.
+	disconnected := make(chan struct{})
+	go func() {
+		usock.ReadMessage()
+		close(disconnected)
+	}()
+
+	for {
+		if status, done := checkWaitTargets(targets); done {
+			return writeJSON(usock, status)
+		}
+		select {
+		case <-sub.C:
+		case <-disconnected:
+			return nil
+		}
+	}
+}
+
+func findWaitTargets(tree *processtree.ProcessTree, args []string) ([]*processtree.SlaveNode, error) {
+	if len(args) == 0 || args[0] == "" {
+		return tree.AllSlaves(), nil
+	}
+
+	name := args[0]
+	if slave := tree.FindSlaveByName(name); slave != nil {
+		return []*processtree.SlaveNode{slave}, nil
+	}
+	if command := tree.FindCommand(name); command != nil {
+		return []*processtree.SlaveNode{command.Parent}, nil
+	}
+	return nil, errors.New("ERROR: Node not found!: " + name)
+}
+
+// checkWaitTargets reports the status of the first crashed target, or
+// of the first target once all of them are ready.
+func checkWaitTargets(targets []*processtree.SlaveNode) (processtree.NodeStatus, bool) {
+	ready := true
+	for _, slave := range targets {
+		switch slave.State() {
+		case processtree.SCrashed:
+			return slave.Status(), true
+		case processtree.SReady:
+		default:
+			ready = false
+		}
+	}
+	if !ready {
+		return processtree.NodeStatus{}, false
+	}
+	if len(targets) == 0 {
+		return processtree.NodeStatus{}, true
+	}
+	return targets[0].Status(), true
+}
@@ -0,0 +1,222 @@
+package clienthandler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/processtree"
+	"github.com/burke/zeus/go/unixsocket"
+	"github.com/burke/zeus/go/zeusslave"
+)
+
+// The test binary runs itself as the slaves of the tree testTree
+// builds; this variable tells it to.
+const slaveTestVar = "CLIENTHANDLER_TEST_SLAVE"
+
+var testPlan = &zeusslave.Plan{
+	Actions: map[string]func() error{
+		"boot":  func() error { return nil },
+		"child": func() error { return nil },
+		"broken": func() error {
+			return errors.New("broken on purpose")
+		},
+		"stalled": func() error {
+			time.Sleep(time.Hour)
+			return nil
+		},
+	},
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(slaveTestVar) != "" {
+		if err := zeusslave.Run(testPlan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testTree runs a tree whose nodes end up ready, crashed, and stuck
+// booting, each with a command, until the test ends.
+func testTree(t *testing.T) *processtree.ProcessTree {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := &processtree.ProcessTree{SlavesByName: make(map[string]*processtree.SlaveNode), ExecCommand: executable}
+	boot := tree.NewSlaveNode("boot", nil, nil)
+	boot.Env = map[string]string{slaveTestVar: "1"}
+	tree.Root = boot
+	for name, command := range map[string]string{"child": "test", "broken": "fail", "stalled": "hang"} {
+		node := tree.NewSlaveNode(name, boot, nil)
+		boot.Slaves = append(boot.Slaves, node)
+		node.Commands = append(node.Commands, tree.NewCommandNode(command, nil, node))
+	}
+
+	done := make(chan bool)
+	quit := processtree.StartSlaveMonitor(tree, nil, done)
+	t.Cleanup(func() {
+		close(quit)
+		<-done
+		for _, slave := range tree.AllSlaves() {
+			slave.Remove()
+		}
+	})
+	return tree
+}
+
+// controlRequest has handleControlRequest service a request from a
+// client, returning the client's end of the connection.
+func controlRequest(t *testing.T, tree *processtree.ProcessTree, op string, args ...string) (*unixsocket.Usock, <-chan bool) {
+	usock, client := clientPair(t)
+	clientSock, err := unixsocket.NewFromFile(client)
+	client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(clientSock.Close)
+	clientSock.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	done := make(chan bool)
+	go func() {
+		handleControlRequest(tree, usock, &messages.Control{Op: op, Args: args}, make(chan bool, 1))
+		close(done)
+	}()
+	return clientSock, done
+}
+
+func waitFor(t *testing.T, tree *processtree.ProcessTree, target string) processtree.NodeStatus {
+	t.Helper()
+	client, _ := controlRequest(t, tree, messages.ControlWait, target)
+	reply, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status processtree.NodeStatus
+	if err := json.Unmarshal([]byte(reply), &status); err != nil {
+		t.Fatalf("expected a node's status, got %q", reply)
+	}
+	return status
+}
+
+func TestWaitRequest(t *testing.T) {
+	tree := testTree(t)
+
+	// Waiting from the start, while the nodes boot.
+	if status := waitFor(t, tree, "child"); status.Name != "child" || status.State != "ready" {
+		t.Errorf("expected child to be ready, got %+v", status)
+	}
+	// A command resolves to the node it runs in.
+	if status := waitFor(t, tree, "test"); status.Name != "child" || status.State != "ready" {
+		t.Errorf("expected test to wait for child, got %+v", status)
+	}
+	status := waitFor(t, tree, "fail")
+	if status.Name != "broken" || status.State != "crashed" || !strings.Contains(status.Error, "broken on purpose") {
+		t.Errorf("expected fail to wait for broken to crash, got %+v", status)
+	}
+	// The whole tree is done once a node crashes.
+	if status := waitFor(t, tree, ""); status.State != "crashed" {
+		t.Errorf("expected the tree to report a crash, got %+v", status)
+	}
+}
+
+func TestWaitRequestForUnknownNode(t *testing.T) {
+	tree := testTree(t)
+
+	client, _ := controlRequest(t, tree, messages.ControlWait, "missing")
+	if reply, err := client.ReadMessage(); err != nil || reply != "ERROR: Node not found!: missing" {
+		t.Errorf("expected an error, got %q and %v", reply, err)
+	}
+}
+
+func TestWaitRequestEndsWhenClientDisconnects(t *testing.T) {
+	tree := testTree(t)
+
+	client, done := controlRequest(t, tree, messages.ControlWait, "hang")
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if reply, err := client.ReadMessage(); err == nil {
+		t.Fatalf("expected no reply while stalled boots, got %q", reply)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to end when the client disconnected")
+	}
+}
+
+// waitForPid waits for node to be ready with a pid other than old,
+// returning its status.
+func waitForPid(t *testing.T, node *processtree.SlaveNode, old int) processtree.NodeStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := node.Status()
+		if status.State == "ready" && status.Pid != old {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s to restart; last saw %+v", node.Name, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func restart(t *testing.T, tree *processtree.ProcessTree, node string) string {
+	t.Helper()
+	client, _ := controlRequest(t, tree, messages.ControlRestart, node)
+	reply, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestRestartRequest(t *testing.T) {
+	tree := testTree(t)
+	boot, child := tree.FindSlaveByName("boot"), tree.FindSlaveByName("child")
+	bootPid := waitForPid(t, boot, 0).Pid
+	childPid := waitForPid(t, child, 0).Pid
+
+	if reply := restart(t, tree, "child"); reply != "OK" {
+		t.Fatalf("expected OK, got %q", reply)
+	}
+	status := waitForPid(t, child, childPid)
+	if status.LastRestart == nil || status.LastRestart.Node != "child" || len(status.LastRestart.Files) != 0 {
+		t.Errorf("expected child to restart on request, got %+v", status.LastRestart)
+	}
+	if pid := boot.Status().Pid; pid != bootPid {
+		t.Errorf("expected boot to keep running as pid %d, but it restarted as %d", bootPid, pid)
+	}
+	childPid = status.Pid
+
+	// Restarting a node restarts the nodes beneath it.
+	if reply := restart(t, tree, "boot"); reply != "OK" {
+		t.Fatalf("expected OK, got %q", reply)
+	}
+	waitForPid(t, boot, bootPid)
+	status = waitForPid(t, child, childPid)
+	if status.LastRestart == nil || status.LastRestart.Node != "boot" {
+		t.Errorf("expected child to restart with boot, got %+v", status.LastRestart)
+	}
+}
+
+func TestRestartRequestForUnknownNode(t *testing.T) {
+	tree := testTree(t)
+
+	for _, node := range []string{"missing", "test", ""} {
+		if reply := restart(t, tree, node); reply != "ERROR: Node not found!: "+node {
+			t.Errorf("%q: expected an error, got %q", node, reply)
+		}
+	}
+}
@@ -23,9 +23,9 @@ var color = true
 
 func main() {
 	args := os.Args[1:]
-	configFile := "zeus.json"
+	configFile := ""
 	simpleStatus := false
-	fileChangeDelay := filemonitor.DefaultFileChangeDelay
+	monitorOptions, monitorErr := filemonitor.OptionsFromEnv()
 	ttyMode := "auto"
 
 	for ; args != nil && len(args) > 0 && args[0][0] == '-'; args = args[1:] {
@@ -56,10 +56,31 @@ func main() {
 					execManPage("zeus")
 				}
 				args = args[1:]
-				fileChangeDelay = delay
+				monitorOptions.FileChangeDelay = delay
 			} else {
 				execManPage("zeus")
 			}
+		case "--file-monitor":
+			if len(args) < 2 {
+				execManPage("zeus")
+				return
+			}
+			monitorOptions.Backend = args[1]
+			args = args[1:]
+		case "--poll-interval":
+			if len(args) < 2 {
+				execManPage("zeus")
+				return
+			}
+			interval, err := time.ParseDuration(args[1])
+			if err != nil {
+				execManPage("zeus")
+				return
+			}
+			monitorOptions.PollInterval = interval
+			args = args[1:]
+		case "--poll-hash":
+			monitorOptions.PollHash = true
 		case "--config":
 			_, err := os.Stat(args[1])
 			if err != nil {
@@ -77,6 +98,9 @@ func main() {
 		execManPage("zeus")
 		return
 	}
+	if configFile == "" {
+		configFile = config.FindConfigFile()
+	}
 
 	if generalHelpRequested(args) {
 		execManPage("zeus")
@@ -85,11 +109,26 @@ func main() {
 	} else if args[0] == "version" {
 		printVersion()
 	} else if args[0] == "start" {
-		os.Exit(zeusmaster.Run(configFile, fileChangeDelay, simpleStatus))
+		if monitorErr != nil {
+			fmt.Println(monitorErr)
+			os.Exit(2)
+		}
+		os.Exit(zeusmaster.Run(configFile, monitorOptions, simpleStatus))
 	} else if args[0] == "init" {
 		zeusInit()
 	} else if args[0] == "restart" {
+		if len(args) > 1 {
+			os.Exit(zeusclient.Restart(args[1]))
+		}
 		zeusRestart()
+	} else if args[0] == "status" {
+		os.Exit(zeusclient.Status(os.Stdout, hasFlag(args[1:], "--json")))
+	} else if args[0] == "stop" {
+		zeusStop(args[1:])
+	} else if args[0] == "wait" {
+		zeusWait(args[1:])
+	} else if args[0] == "config" && len(args) > 1 && args[1] == "check" {
+		zeusConfigCheck(configFile)
 	} else if args[0] == "commands" {
 		zeusCommands(configFile)
 	} else {
@@ -98,7 +137,7 @@ func main() {
 			if args[0] == name {
 				// Don't confuse the master by sending *full* args to
 				// it; just those that are not zeus-specific.
-				os.Exit(zeusclient.Run(args, os.Stdin, os.Stdout, os.Stderr, ttyMode))
+				os.Exit(zeusclient.Run(args, tree.ClientEnv, os.Stdin, os.Stdout, os.Stderr, ttyMode))
 			}
 		}
 
@@ -189,6 +228,15 @@ func commandSpecificHelp(args []string) {
 	}
 }
 
+func hasFlag(args []string, flag string) bool {
+	for _, arg := range args {
+		if arg == flag {
+			return true
+		}
+	}
+	return false
+}
+
 func generalHelpRequested(args []string) bool {
 	helps := []string{"help", "--help", "-h", "--help", "-?", "?"}
 	if len(args) == 1 {
@@ -201,6 +249,56 @@ func generalHelpRequested(args []string) bool {
 	return false
 }
 
+func zeusStop(args []string) {
+	timeout := 10 * time.Second
+	if len(args) > 1 && args[0] == "--timeout" {
+		var err error
+		if timeout, err = time.ParseDuration(args[1]); err != nil {
+			execManPage("zeus")
+		}
+	}
+	os.Exit(zeusclient.Stop(zeusmaster.PidFile, timeout))
+}
+
+func zeusWait(args []string) {
+	var target string
+	var timeout time.Duration
+	for ; len(args) > 0; args = args[1:] {
+		if args[0] == "--timeout" {
+			if len(args) < 2 {
+				execManPage("zeus")
+			}
+			var err error
+			if timeout, err = time.ParseDuration(args[1]); err != nil {
+				execManPage("zeus")
+			}
+			args = args[1:]
+		} else {
+			target = args[0]
+		}
+	}
+	os.Exit(zeusclient.Wait(target, timeout, os.Stderr))
+}
+
+func zeusConfigCheck(configFile string) {
+	err := config.Check(configFile)
+	if err == nil {
+		fmt.Println(configFile + " is valid.")
+		return
+	}
+	if errs, ok := err.(config.ValidationErrors); ok {
+		for _, problem := range errs {
+			println(red() + problem.Error() + reset())
+		}
+		if len(errs) > 1 {
+			println(red() + fmt.Sprintf("%d problems found in %s.", len(errs), configFile) + reset())
+		}
+	} else {
+		println(red() + err.Error() + reset())
+	}
+	os.Exit(1)
+}
+
 func zeusRestart() {
 	pidBytes, err := os.ReadFile(zeusmaster.PidFile)
 	if err != nil {
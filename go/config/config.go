@@ -3,70 +3,254 @@ package config
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/burke/zeus/go/filemonitor"
 	"github.com/burke/zeus/go/processtree"
 	"github.com/burke/zeus/go/zerror"
+	"gopkg.in/yaml.v3"
 )
 
 type config struct {
-	Command string
-	Plan    interface{}
-	Items   map[string]string
+	Command        string
+	BootTimeout    string `json:"boot_timeout" yaml:"boot_timeout" toml:"boot_timeout"`
+	CommandTimeout string `json:"command_timeout" yaml:"command_timeout" toml:"command_timeout"`
+	Retries        int
+	RetryBackoff   string   `json:"retry_backoff" yaml:"retry_backoff" toml:"retry_backoff"`
+	ClientEnv      []string `json:"client_env" yaml:"client_env" toml:"client_env"`
+	Plan           interface{}
+	Items          map[string]string
+	Nodes          map[string]nodeConfig
+	Commands       map[string]commandConfig
+	Watch          watchConfig
+
+	// root is the directory of the config file, which paths in it are
+	// relative to.
+	root string
+}
+
+// watchConfig holds settings for the file monitor.
+type watchConfig struct {
+	// Ignore lists .gitignore-style patterns for files not to watch.
+	Ignore []string
+	// Gitignore also ignores the files the project's .gitignore does.
+	Gitignore bool
+}
+
+// nodeConfig holds settings for a single node in the plan, by name.
+type nodeConfig struct {
+	BootTimeout  string `json:"boot_timeout" yaml:"boot_timeout" toml:"boot_timeout"`
+	Retries      *int
+	RetryBackoff string `json:"retry_backoff" yaml:"retry_backoff" toml:"retry_backoff"`
+	Env          map[string]string
+	Watch        []string
+}
+
+// commandConfig holds settings for a single command in the plan, by
+// name.
+type commandConfig struct {
+	Env map[string]string
+}
+
+// DefaultConfigFiles are the config files looked for in the current
+// directory when none is given, in order of preference.
+var DefaultConfigFiles = []string{"zeus.json", "zeus.yml", "zeus.yaml", "zeus.toml"}
+
+// FindConfigFile returns the first of DefaultConfigFiles that exists,
+// or zeus.json if none do.
+func FindConfigFile() string {
+	for _, name := range DefaultConfigFiles {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return DefaultConfigFiles[0]
+}
+
+const defaultRetryBackoff = time.Second
+
+// ErrInvalidJSON, ErrInvalidYAML, and ErrInvalidTOML are the kinds of
+// ValidationError for config files that can't be parsed, and
+// ErrInvalidFormat for those that parse but don't describe a valid plan.
+var (
+	ErrInvalidJSON   = errors.New("The config file contains invalid JSON and could not be parsed")
+	ErrInvalidYAML   = errors.New("The config file contains invalid YAML and could not be parsed")
+	ErrInvalidTOML   = errors.New("The config file contains invalid TOML and could not be parsed")
+	ErrInvalidFormat = errors.New("The config file is not in the correct format")
+)
+
+// bootTimeout is the node's own boot timeout if it has one, otherwise
+// the global default. Zero means no timeout.
+func (c *config) bootTimeout(name string) (time.Duration, error) {
+	timeout := c.BootTimeout
+	if node, ok := c.Nodes[name]; ok && node.BootTimeout != "" {
+		timeout = node.BootTimeout
+	}
+	return parseDuration(timeout)
 }
 
-// BuildProcessTree builds the process tree.
+// retries is the number of times the node is automatically restarted
+// after crashing, and how long to wait before the first time.
+func (c *config) retries(name string) (int, time.Duration, error) {
+	retries, backoff := c.Retries, c.RetryBackoff
+	if node, ok := c.Nodes[name]; ok {
+		if node.Retries != nil {
+			retries = *node.Retries
+		}
+		if node.RetryBackoff != "" {
+			backoff = node.RetryBackoff
+		}
+	}
+	if backoff == "" {
+		return retries, defaultRetryBackoff, nil
+	}
+	d, err := parseDuration(backoff)
+	return retries, d, err
+}
+
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, ErrInvalidFormat
+	}
+	return d, nil
+}
+
+// BuildProcessTree builds the process tree, exiting if the config file
+// is invalid.
 func BuildProcessTree(configFile string, monitor filemonitor.FileMonitor) *processtree.ProcessTree {
-	conf := parseConfig(configFile)
+	tree, err := LoadProcessTree(configFile, monitor)
+	if err != nil {
+		zerror.ErrorConfigFileInvalid(configFile, strings.Split(err.Error(), "\n"))
+	}
+	return tree
+}
+
+// LoadProcessTree builds the process tree, returning an error if the
+// config file is invalid.
+func LoadProcessTree(configFile string, monitor filemonitor.FileMonitor) (*processtree.ProcessTree, error) {
+	conf, err := parseConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
 	tree := &processtree.ProcessTree{}
 	tree.SlavesByName = make(map[string]*processtree.SlaveNode)
-	tree.StateChanged = make(chan bool, 16)
 
 	tree.ExecCommand = conf.Command
+	tree.ClientEnv = conf.ClientEnv
+	if tree.CommandTimeout, err = parseDuration(conf.CommandTimeout); err != nil {
+		return nil, err
+	}
+
+	if conf.root, err = filepath.Abs(filepath.Dir(configFile)); err != nil {
+		return nil, err
+	}
+	if tree.WatchIgnore, err = conf.watchIgnore(); err != nil {
+		return nil, err
+	}
 
 	plan, ok := conf.Plan.(map[string]interface{})
 	if !ok {
-		zerror.ErrorConfigFileInvalidFormat()
+		return nil, ErrInvalidFormat
+	}
+	if err := iteratePlan(tree, &conf, plan, monitor, nil); err != nil {
+		return nil, err
+	}
+	if tree.Root == nil {
+		return nil, ErrInvalidFormat
 	}
-	iteratePlan(tree, plan, monitor, nil)
 
-	return tree
+	return tree, nil
+}
+
+// watchIgnore builds the rules for files the monitor skips.
+func (conf *config) watchIgnore() (*filemonitor.Ignore, error) {
+	ignore, err := filemonitor.NewIgnore(conf.root, conf.Watch.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Watch.Gitignore {
+		if err := ignore.AddGitignore(filepath.Join(conf.root, ".gitignore")); err != nil {
+			return nil, err
+		}
+	}
+	return ignore, nil
+}
+
+// watchGlobs returns the extra files a node watches, as absolute
+// patterns.
+func (conf *config) watchGlobs(name string) []filemonitor.Glob {
+	var globs []filemonitor.Glob
+	for _, pattern := range conf.Nodes[name].Watch {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(conf.root, pattern)
+		}
+		globs = append(globs, filemonitor.Glob(pattern))
+	}
+	return globs
 }
 
 func iteratePlan(
 	tree *processtree.ProcessTree,
+	conf *config,
 	plan map[string]interface{},
 	monitor filemonitor.FileMonitor,
 	parent *processtree.SlaveNode,
-) {
+) error {
 	for name, v := range plan {
 		if subPlan, ok := v.(map[string]interface{}); ok {
 			newNode := tree.NewSlaveNode(name, parent, monitor)
+			var err error
+			if newNode.BootTimeout, err = conf.bootTimeout(name); err != nil {
+				return err
+			}
+			if newNode.Retries, newNode.RetryBackoff, err = conf.retries(name); err != nil {
+				return err
+			}
+			newNode.Env = conf.Nodes[name].Env
+			newNode.Watch = conf.watchGlobs(name)
 			if parent == nil {
 				tree.Root = newNode
 			} else {
 				parent.Slaves = append(parent.Slaves, newNode)
 			}
-			iteratePlan(tree, subPlan, monitor, newNode)
+			if err := iteratePlan(tree, conf, subPlan, monitor, newNode); err != nil {
+				return err
+			}
 		} else {
+			if parent == nil {
+				return ErrInvalidFormat
+			}
 			var newNode *processtree.CommandNode
 			if aliases, ok := v.([]interface{}); ok {
 				strs := make([]string, len(aliases))
 				for i, alias := range aliases {
-					strs[i] = alias.(string)
+					if strs[i], ok = alias.(string); !ok {
+						return ErrInvalidFormat
+					}
 				}
 				newNode = tree.NewCommandNode(name, strs, parent)
 			} else if v == nil {
 				newNode = tree.NewCommandNode(name, nil, parent)
 			} else {
-				zerror.ErrorConfigFileInvalidFormat()
+				return ErrInvalidFormat
 			}
+			newNode.Env = conf.Commands[name].Env
 			parent.Commands = append(parent.Commands, newNode)
 		}
 	}
+	return nil
 }
 
 func defaultConfigPath() string {
@@ -76,32 +260,89 @@ func defaultConfigPath() string {
 	return jsonpath
 }
 
-func readConfigFileOrDefault(configFile string) ([]byte, error) {
+// readConfigFileOrDefault returns the contents of the config file, or
+// of the default one if it doesn't exist, and the name of the file read.
+func readConfigFileOrDefault(configFile string) ([]byte, string, error) {
 	contents, err := readFile(configFile)
 	if err != nil {
 		switch err.(type) {
 		case *os.PathError:
-			return readFile(defaultConfigPath())
-		default:
-			return contents, err
+			configFile = defaultConfigPath()
+			contents, err = readFile(configFile)
 		}
 	}
-	return contents, err
+	return contents, configFile, err
 }
 
-func parseConfig(configFile string) (c config) {
+// parseConfig reads and validates the config file, returning every
+// problem found as ValidationErrors.
+func parseConfig(configFile string) (config, error) {
 	var conf config
 
-	contents, err := readConfigFileOrDefault(configFile)
+	contents, configFile, err := readConfigFileOrDefault(configFile)
 	if err != nil {
-		zerror.ErrorConfigFileInvalidJSON()
+		return conf, ValidationErrors{{File: configFile, Err: ErrInvalidJSON, Msg: err.Error()}}
 	}
 
-	err = json.Unmarshal(contents, &conf)
-	if err != nil {
-		zerror.ErrorConfigFileInvalidJSON()
+	var pos positions
+	var repeated []repeatedKey
+	switch strings.ToLower(filepath.Ext(configFile)) {
+	case ".yml", ".yaml":
+		if err := yaml.Unmarshal(contents, &conf); err != nil {
+			return conf, syntaxErrors(configFile, contents, ErrInvalidYAML, err)
+		}
+		// YAML allows keys that aren't strings, which yaml.v3 decodes
+		// into a different kind of map.
+		conf.Plan = stringKeys(conf.Plan)
+		pos = yamlPositions(contents)
+	case ".toml":
+		if err := toml.Unmarshal(contents, &conf); err != nil {
+			return conf, syntaxErrors(configFile, contents, ErrInvalidTOML, err)
+		}
+	default:
+		if err := json.Unmarshal(contents, &conf); err != nil {
+			return conf, syntaxErrors(configFile, contents, ErrInvalidJSON, err)
+		}
+		pos, repeated = jsonPositions(contents)
+	}
+
+	return conf, validate(configFile, &conf, pos, repeated)
+}
+
+// Check reads the config file and reports every problem with it, or nil
+// if there are none. Unlike LoadProcessTree, it doesn't fall back to the
+// default plan if the file doesn't exist.
+func Check(configFile string) error {
+	if _, err := os.Stat(configFile); err != nil {
+		return err
+	}
+	_, err := parseConfig(configFile)
+	return err
+}
+
+// stringKeys converts any maps with non-string keys in a decoded plan
+// into maps with string keys, so every format yields the same shape.
+func stringKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = stringKeys(value)
+		}
+		return m
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = stringKeys(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringKeys(value)
+		}
+		return v
+	default:
+		return v
 	}
-	return conf
 }
 
 func readFile(path string) (contents []byte, err error) {
@@ -0,0 +1,291 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+var configFormats = map[string]string{
+	"zeus.json": `{
+  "command": "ruby -rzeus -eZeus.go",
+  "retries": 2,
+  "plan": {
+    "boot": {
+      "default_bundle": {
+        "test_environment": {"test": ["rspec", "t"]},
+        "console": null
+      }
+    }
+  },
+  "nodes": {"test_environment": {"boot_timeout": "30s", "env": {"RAILS_ENV": "test"}}},
+  "commands": {"test": {"env": {"COVERAGE": "1"}}}
+}`,
+	"zeus.yml": `
+# The same plan, with comments.
+command: ruby -rzeus -eZeus.go
+retries: 2
+plan:
+  boot:
+    default_bundle:
+      test_environment:
+        test: [rspec, t]
+      console:
+nodes:
+  test_environment:
+    boot_timeout: 30s
+    env:
+      RAILS_ENV: test
+commands:
+  test:
+    env: {COVERAGE: "1"}
+`,
+	"zeus.toml": `
+# The same plan, with comments.
+command = "ruby -rzeus -eZeus.go"
+retries = 2
+
+[plan.boot.default_bundle]
+console = []
+
+[plan.boot.default_bundle.test_environment]
+test = ["rspec", "t"]
+
+[nodes.test_environment]
+boot_timeout = "30s"
+env = { RAILS_ENV = "test" }
+
+[commands.test.env]
+COVERAGE = "1"
+`,
+}
+
+func TestLoadProcessTreeFormats(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, contents := range configFormats {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err := LoadProcessTree(file, nil)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if tree.ExecCommand != "ruby -rzeus -eZeus.go" {
+			t.Errorf("%s: unexpected command %q", name, tree.ExecCommand)
+		}
+		if tree.Root == nil || tree.Root.Name != "boot" {
+			t.Fatalf("%s: expected boot to be the root", name)
+		}
+
+		commands := tree.AllCommandsAndAliases()
+		sort.Strings(commands)
+		if expected := []string{"console", "rspec", "t", "test"}; !reflect.DeepEqual(commands, expected) {
+			t.Errorf("%s: expected commands %v, got %v", name, expected, commands)
+		}
+
+		node := tree.FindSlaveByName("test_environment")
+		if node == nil || node.Parent.Name != "default_bundle" {
+			t.Fatalf("%s: expected test_environment under default_bundle", name)
+		}
+		if node.BootTimeout != 30*time.Second || node.Retries != 2 {
+			t.Errorf("%s: unexpected settings %v, %d retries", name, node.BootTimeout, node.Retries)
+		}
+		if !reflect.DeepEqual(node.Env, map[string]string{"RAILS_ENV": "test"}) {
+			t.Errorf("%s: unexpected node env %v", name, node.Env)
+		}
+		if command := tree.FindCommand("t"); !reflect.DeepEqual(command.Env, map[string]string{"COVERAGE": "1"}) {
+			t.Errorf("%s: unexpected command env %v", name, command.Env)
+		}
+	}
+}
+
+func TestLoadProcessTreeInvalidSyntax(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, expected := range map[string]error{
+		"zeus.json": ErrInvalidJSON,
+		"zeus.yaml": ErrInvalidYAML,
+		"zeus.toml": ErrInvalidTOML,
+	} {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte("plan: {[\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadProcessTree(file, nil); !errors.Is(err, expected) {
+			t.Errorf("%s: expected %v, got %v", name, expected, err)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zeus.json")
+	contents := `{
+  "command": " ",
+  "boot_timeout": "soon",
+  "nodes": {"test_enviroment": {"env": {"A=B": "c"}}},
+  "plan": {
+    "boot": {
+      "default_bundle": {
+        "test": ["t", 3],
+        "t": null,
+        "test_environment": {}
+      },
+      "test_environment": {"rspec": ["test"]}
+    },
+    "console": []
+  }
+}`
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Check(file)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("expected ValidationErrors, got %v", err)
+	}
+
+	expected := []struct {
+		line, column int
+		path         string
+		kind         error
+	}{
+		{2, 3, "command", ErrEmptyCommand},
+		{3, 3, "boot_timeout", ErrInvalidFormat},
+		{4, 13, "nodes.test_enviroment", ErrInvalidFormat},
+		{4, 41, "nodes.test_enviroment.env.A=B", ErrInvalidFormat},
+		{8, 23, "plan.boot.default_bundle.test[1]", ErrNonStringAlias},
+		{9, 9, "plan.boot.default_bundle.t", ErrAliasCollision},
+		{12, 7, "plan.boot.test_environment", ErrDuplicateName},
+		{12, 38, "plan.boot.test_environment.rspec[0]", ErrAliasCollision},
+		{14, 5, "plan.console", ErrCommandAtRoot},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d problems, got %d:\n%v", len(expected), len(errs), err)
+	}
+	for i, e := range expected {
+		got := errs[i]
+		if got.Line != e.line || got.Column != e.column || got.Path != e.path || !errors.Is(got, e.kind) {
+			t.Errorf("expected %s at %d:%d (%v), got %s", e.path, e.line, e.column, e.kind, got)
+		}
+	}
+}
+
+func TestCheckRepeatedKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zeus.json")
+	contents := `{"command": "ruby", "plan": {"boot": {"a": {}, "a": {}}}}`
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := Check(file)
+	if !errors.Is(err, ErrDuplicateName) || !strings.HasPrefix(err.Error(), file+":1:48: plan.boot.a: ") {
+		t.Errorf("expected the repeated key to be reported, got %v", err)
+	}
+}
+
+func TestCheckValid(t *testing.T) {
+	dir := t.TempDir()
+
+	for name, contents := range configFormats {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := Check(file); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if err := Check(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("expected a missing file to be reported, got %v", err)
+	}
+}
+
+func TestLoadWatchIgnore(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "zeus.json")
+	contents := `{
+  "command": "ruby",
+  "plan": {"boot": {"console": null}},
+  "watch": {"ignore": ["*.swp", "tmp/cache/"], "gitignore": true}
+}`
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("/log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := LoadProcessTree(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{
+		"app/.user.rb.swp":    true,
+		"tmp/cache/assets/a":  true,
+		"log/test.log":        true,
+		"app/models/user.rb":  false,
+		"config/database.yml": false,
+	} {
+		if got := tree.WatchIgnore.Match(filepath.Join(dir, name)); got != expected {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+		}
+	}
+
+	contents = `{"command": "ruby", "plan": {"boot": {}}, "watch": {"ignore": ["log/", "["]}}`
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = Check(file)
+	if !errors.Is(err, ErrInvalidFormat) || !strings.Contains(err.Error(), "watch.ignore[1]: ") {
+		t.Errorf("expected the invalid pattern to be reported, got %v", err)
+	}
+}
+
+func TestLoadNodeWatch(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "zeus.json")
+	contents := `{
+  "command": "ruby",
+  "plan": {"boot": {"console": null}},
+  "nodes": {"boot": {"watch": ["config/database.yml", "/etc/hosts", "config/locales/**/*.yml"]}}
+}`
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := LoadProcessTree(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []filemonitor.Glob{
+		filemonitor.Glob(filepath.Join(dir, "config/database.yml")),
+		"/etc/hosts",
+		filemonitor.Glob(filepath.Join(dir, "config/locales/**/*.yml")),
+	}
+	if !reflect.DeepEqual(tree.Root.Watch, expected) {
+		t.Errorf("expected %q, got %q", expected, tree.Root.Watch)
+	}
+
+	contents = `{"command": "ruby", "plan": {"boot": {}}, "nodes": {"boot": {"watch": [""]}}}`
+	if err := os.WriteFile(file, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = Check(file)
+	if !errors.Is(err, ErrInvalidFormat) || !strings.Contains(err.Error(), "nodes.boot.watch[0]: ") {
+		t.Errorf("expected the empty pattern to be reported, got %v", err)
+	}
+}
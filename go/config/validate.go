@@ -0,0 +1,533 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/burke/zeus/go/filemonitor"
+	"gopkg.in/yaml.v3"
+)
+
+// The kinds of problem a ValidationError can describe, in addition to
+// ErrInvalidJSON, ErrInvalidYAML, ErrInvalidTOML, and ErrInvalidFormat.
+var (
+	ErrDuplicateName  = errors.New("duplicate name")
+	ErrAliasCollision = errors.New("alias collision")
+	ErrCommandAtRoot  = errors.New("command at the root of the plan")
+	ErrNonStringAlias = errors.New("alias is not a string")
+	ErrEmptyCommand   = errors.New("empty command")
+)
+
+// A ValidationError is a problem with the config file. Err is the kind
+// of problem, for use with errors.Is. Line and Column are zero when the
+// position isn't known, which is always the case for TOML files other
+// than syntax errors. Path names the setting, like
+// "plan.boot.default_bundle".
+type ValidationError struct {
+	File   string
+	Line   int
+	Column int
+	Path   string
+	Err    error
+	Msg    string
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&b, ":%d", e.Column)
+		}
+	}
+	b.WriteString(": ")
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors is every problem found in a config file, in the order
+// they appear in it.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Is reports whether any of the problems is of the target kind.
+func (errs ValidationErrors) Is(target error) bool {
+	for _, err := range errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// position is where a key or list element appears in the config file.
+// Line and Column start at 1.
+type position struct {
+	Line, Column int
+}
+
+// positions maps paths in the config file, like "plan.boot" or
+// "plan.boot.console[0]", to where they appear.
+type positions map[string]position
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func indexPath(path string, i int) string {
+	return path + "[" + strconv.Itoa(i) + "]"
+}
+
+func offsetPosition(contents []byte, offset int) position {
+	if offset > len(contents) {
+		offset = len(contents)
+	}
+	before := contents[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := offset - bytes.LastIndexByte(before, '\n')
+	return position{line, column}
+}
+
+// A repeatedKey is a key that appears more than once in the same JSON
+// object, which encoding/json silently merges.
+type repeatedKey struct {
+	path string
+	pos  position
+}
+
+// jsonPositions finds where each key and list element in a JSON
+// document starts.
+func jsonPositions(contents []byte) (positions, []repeatedKey) {
+	pos := positions{}
+	var repeated []repeatedKey
+
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	// The decoder stops just after the previous token, so skip ahead to
+	// the start of the next one.
+	next := func() position {
+		offset := int(dec.InputOffset())
+		for offset < len(contents) && strings.IndexByte(" \t\r\n,:", contents[offset]) >= 0 {
+			offset++
+		}
+		return offsetPosition(contents, offset)
+	}
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			seen := make(map[string]bool)
+			for dec.More() {
+				p := next()
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key, _ := tok.(string)
+				keyPath := joinPath(path, key)
+				if seen[key] {
+					repeated = append(repeated, repeatedKey{keyPath, p})
+				} else {
+					seen[key] = true
+					pos[keyPath] = p
+				}
+				if err := walk(keyPath); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				elemPath := indexPath(path, i)
+				pos[elemPath] = next()
+				if err := walk(elemPath); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+		// The closing delimiter.
+		_, err = dec.Token()
+		return err
+	}
+	walk("")
+
+	return pos, repeated
+}
+
+// yamlPositions finds where each key and list element in a YAML
+// document starts.
+func yamlPositions(contents []byte) positions {
+	pos := positions{}
+
+	var root yaml.Node
+	if yaml.Unmarshal(contents, &root) != nil {
+		return pos
+	}
+
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				walk(child, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i]
+				keyPath := joinPath(path, key.Value)
+				pos[keyPath] = position{key.Line, key.Column}
+				walk(node.Content[i+1], keyPath)
+			}
+		case yaml.SequenceNode:
+			for i, child := range node.Content {
+				elemPath := indexPath(path, i)
+				pos[elemPath] = position{child.Line, child.Column}
+				walk(child, elemPath)
+			}
+		}
+	}
+	walk(&root, "")
+
+	return pos
+}
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// syntaxErrors describes an error from decoding the config file.
+func syntaxErrors(file string, contents []byte, kind error, err error) ValidationErrors {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		p := offsetPosition(contents, int(err.Offset))
+		return ValidationErrors{{file, p.Line, p.Column, "", kind, "invalid JSON: " + err.Error()}}
+	case *json.UnmarshalTypeError:
+		p := offsetPosition(contents, int(err.Offset))
+		return ValidationErrors{{file, p.Line, p.Column, err.Field, ErrInvalidFormat,
+			fmt.Sprintf("expected %s, not %s", err.Type, err.Value)}}
+	case *yaml.TypeError:
+		var errs ValidationErrors
+		for _, msg := range err.Errors {
+			e := &ValidationError{File: file, Err: ErrInvalidFormat, Msg: msg}
+			if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+				e.Line, _ = strconv.Atoi(m[1])
+				e.Msg = m[2]
+			}
+			if strings.Contains(e.Msg, "already defined") {
+				e.Err = ErrDuplicateName
+			}
+			errs = append(errs, e)
+		}
+		return errs
+	case toml.ParseError:
+		p := offsetPosition(contents, err.Position.Start)
+		msg := err.Message
+		if msg == "" {
+			msg = strings.TrimPrefix(err.Error(), "toml: ")
+		}
+		return ValidationErrors{{file, p.Line, p.Column, "", kind, "invalid TOML: " + msg}}
+	}
+
+	e := &ValidationError{File: file, Err: kind, Msg: strings.TrimPrefix(err.Error(), "toml: ")}
+	if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		e.Line, _ = strconv.Atoi(m[1])
+		e.Msg = "invalid YAML: " + m[2]
+	}
+	return ValidationErrors{e}
+}
+
+// A nameUse is a command name or alias, and where it was defined.
+type nameUse struct {
+	path    string
+	what    string
+	isAlias bool
+}
+
+type validator struct {
+	file string
+	pos  positions
+	errs ValidationErrors
+
+	nodes map[string][]string
+	names map[string][]nameUse
+}
+
+// validate checks the config for every problem that would stop it from
+// being loaded, or make it behave differently than it reads.
+func validate(file string, conf *config, pos positions, repeated []repeatedKey) error {
+	v := &validator{
+		file:  file,
+		pos:   pos,
+		nodes: make(map[string][]string),
+		names: make(map[string][]nameUse),
+	}
+
+	for _, key := range repeated {
+		v.addAt(key.pos, key.path, ErrDuplicateName, "is defined more than once; only the last one is used")
+	}
+
+	if strings.TrimSpace(conf.Command) == "" {
+		v.add("command", ErrEmptyCommand, "is empty; it should start the root node of the plan")
+	}
+	v.checkDuration("boot_timeout", conf.BootTimeout)
+	v.checkDuration("command_timeout", conf.CommandTimeout)
+	v.checkDuration("retry_backoff", conf.RetryBackoff)
+	v.checkRetries("retries", conf.Retries)
+	for i, pattern := range conf.ClientEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			v.add(indexPath("client_env", i), ErrInvalidFormat, "%q is not a valid pattern", pattern)
+		}
+	}
+	for i, pattern := range conf.Watch.Ignore {
+		if err := filemonitor.CheckIgnorePattern(pattern); err != nil {
+			v.add(indexPath(joinPath("watch", "ignore"), i), ErrInvalidFormat, "%v", err)
+		}
+	}
+	for _, name := range sortedKeys(conf.Nodes) {
+		node := conf.Nodes[name]
+		path := joinPath("nodes", name)
+		v.checkDuration(joinPath(path, "boot_timeout"), node.BootTimeout)
+		v.checkDuration(joinPath(path, "retry_backoff"), node.RetryBackoff)
+		if node.Retries != nil {
+			v.checkRetries(joinPath(path, "retries"), *node.Retries)
+		}
+		v.checkEnv(joinPath(path, "env"), node.Env)
+		for i, pattern := range node.Watch {
+			if err := filemonitor.CheckGlob(pattern); err != nil {
+				v.add(indexPath(joinPath(path, "watch"), i), ErrInvalidFormat, "%v", err)
+			}
+		}
+	}
+	for _, name := range sortedKeys(conf.Commands) {
+		v.checkEnv(joinPath(joinPath("commands", name), "env"), conf.Commands[name].Env)
+	}
+
+	v.checkPlan(conf.Plan)
+	v.checkDuplicates()
+	v.checkSettingsNames(conf)
+
+	if len(v.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(v.errs, func(i, j int) bool {
+		a, b := v.errs[i], v.errs[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Path < b.Path
+	})
+	return v.errs
+}
+
+func (v *validator) add(path string, kind error, format string, args ...interface{}) {
+	v.addAt(v.pos[path], path, kind, format, args...)
+}
+
+func (v *validator) addAt(p position, path string, kind error, format string, args ...interface{}) {
+	v.errs = append(v.errs, &ValidationError{v.file, p.Line, p.Column, path, kind, fmt.Sprintf(format, args...)})
+}
+
+// where describes the location of a path, for pointing at the other
+// half of a conflict.
+func (v *validator) where(path string) string {
+	if p, ok := v.pos[path]; ok {
+		return fmt.Sprintf("%s (line %d)", path, p.Line)
+	}
+	return path
+}
+
+// before orders paths by where they appear in the file, falling back to
+// their names when the positions aren't known.
+func (v *validator) before(a, b string) bool {
+	pa, pb := v.pos[a], v.pos[b]
+	if pa.Line != pb.Line {
+		return pa.Line < pb.Line
+	}
+	if pa.Column != pb.Column {
+		return pa.Column < pb.Column
+	}
+	return a < b
+}
+
+func (v *validator) checkDuration(path, value string) {
+	if value == "" {
+		return
+	}
+	if _, err := time.ParseDuration(value); err != nil {
+		v.add(path, ErrInvalidFormat, "%q is not a duration, like \"30s\" or \"2m\"", value)
+	}
+}
+
+func (v *validator) checkRetries(path string, retries int) {
+	if retries < 0 {
+		v.add(path, ErrInvalidFormat, "must not be negative")
+	}
+}
+
+func (v *validator) checkEnv(path string, env map[string]string) {
+	for _, key := range sortedKeys(env) {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			v.add(joinPath(path, key), ErrInvalidFormat, "%q is not a valid environment variable name", key)
+		} else if strings.ContainsRune(env[key], 0) {
+			v.add(joinPath(path, key), ErrInvalidFormat, "environment variables can't contain NUL bytes")
+		}
+	}
+}
+
+// checkSettingsNames makes sure settings for nodes and commands refer
+// to ones in the plan, so a typo doesn't go unnoticed.
+func (v *validator) checkSettingsNames(conf *config) {
+	for _, name := range sortedKeys(conf.Nodes) {
+		if v.nodes[name] == nil {
+			v.add(joinPath("nodes", name), ErrInvalidFormat, "there is no node named %q in the plan", name)
+		}
+	}
+	for _, name := range sortedKeys(conf.Commands) {
+		isCommand := false
+		for _, use := range v.names[name] {
+			isCommand = isCommand || !use.isAlias
+		}
+		if !isCommand {
+			v.add(joinPath("commands", name), ErrInvalidFormat, "there is no command named %q in the plan", name)
+		}
+	}
+}
+
+func (v *validator) checkPlan(value interface{}) {
+	plan, ok := value.(map[string]interface{})
+	if !ok {
+		v.add("plan", ErrInvalidFormat, "plan must be an object containing a single root node")
+		return
+	}
+
+	roots := 0
+	for _, name := range sortedKeys(plan) {
+		path := joinPath("plan", name)
+		if subPlan, ok := plan[name].(map[string]interface{}); ok {
+			roots++
+			v.nodes[name] = append(v.nodes[name], path)
+			v.checkNode(path, subPlan)
+		} else {
+			v.add(path, ErrCommandAtRoot, "command %q must be inside a node, not at the top level of the plan", name)
+		}
+	}
+	if roots == 0 {
+		v.add("plan", ErrInvalidFormat, "plan has no root node")
+	} else if roots > 1 {
+		v.add("plan", ErrInvalidFormat, "plan has %d root nodes; there must be exactly one", roots)
+	}
+}
+
+func (v *validator) checkNode(path string, plan map[string]interface{}) {
+	for _, name := range sortedKeys(plan) {
+		childPath := joinPath(path, name)
+		switch value := plan[name].(type) {
+		case map[string]interface{}:
+			v.nodes[name] = append(v.nodes[name], childPath)
+			v.checkNode(childPath, value)
+		case []interface{}:
+			v.useName(name, childPath, fmt.Sprintf("command %q", name), false)
+			for i, alias := range value {
+				aliasPath := indexPath(childPath, i)
+				if s, ok := alias.(string); ok {
+					v.useName(s, aliasPath, fmt.Sprintf("alias %q of %s", s, name), true)
+				} else {
+					v.add(aliasPath, ErrNonStringAlias, "alias of %s must be a string, not %v", name, alias)
+				}
+			}
+		case nil:
+			v.useName(name, childPath, fmt.Sprintf("command %q", name), false)
+		default:
+			v.add(childPath, ErrInvalidFormat,
+				"must be a node (an object) or a command (a list of aliases, or null), not %v", value)
+		}
+	}
+}
+
+func (v *validator) useName(name, path, what string, isAlias bool) {
+	v.names[name] = append(v.names[name], nameUse{path, what, isAlias})
+}
+
+func (v *validator) checkDuplicates() {
+	for name, paths := range v.nodes {
+		if len(paths) < 2 {
+			continue
+		}
+		sort.Slice(paths, func(i, j int) bool { return v.before(paths[i], paths[j]) })
+		for _, path := range paths[1:] {
+			v.add(path, ErrDuplicateName, "node %q is already defined at %s", name, v.where(paths[0]))
+		}
+	}
+
+	for _, uses := range v.names {
+		if len(uses) < 2 {
+			continue
+		}
+		sort.Slice(uses, func(i, j int) bool { return v.before(uses[i].path, uses[j].path) })
+		first := uses[0]
+		for _, use := range uses[1:] {
+			kind := ErrDuplicateName
+			if use.isAlias || first.isAlias {
+				kind = ErrAliasCollision
+			}
+			v.add(use.path, kind, "%s conflicts with %s at %s", use.what, first.what, v.where(first.path))
+		}
+	}
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]interface{}:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]nodeConfig:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]commandConfig:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]string:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
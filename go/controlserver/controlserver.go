@@ -0,0 +1,170 @@
+// Package controlserver serves the master's control operations as
+// JSON-RPC 2.0 on a socket next to the client socket, so that editor
+// plugins and other tools can drive and observe the master without
+// running commands or scraping the status chart. Requests, responses and
+// notifications are JSON objects, one per line.
+//
+// See docs/control_api.md for the methods.
+package controlserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/burke/zeus/go/processtree"
+	slog "github.com/burke/zeus/go/shinylog"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+// Start listens on the control socket until quit is closed, then
+// closes every open connection, removes the socket, and signals done.
+func Start(tree *processtree.ProcessTree, done chan bool) chan bool {
+	quit := make(chan bool)
+	go func() {
+		path, _ := filepath.Abs(unixsocket.ControlSockName())
+		os.Remove(path) // Clean up stale socket from previous session
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			// The control socket is a convenience for tools; Zeus
+			// works without it.
+			slog.Error(err)
+			<-quit
+			done <- true
+			return
+		}
+
+		var connsL sync.Mutex
+		conns := make(map[net.Conn]bool)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return // listener was closed
+				}
+				connsL.Lock()
+				conns[conn] = true
+				connsL.Unlock()
+				go func() {
+					serve(tree, conn)
+					conn.Close()
+					connsL.Lock()
+					delete(conns, conn)
+					connsL.Unlock()
+				}()
+			}
+		}()
+
+		<-quit
+		listener.Close()
+		connsL.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		connsL.Unlock()
+		os.Remove(path)
+		done <- true
+	}()
+	return quit
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type notification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes: the first four are defined by JSON-RPC, and the rest are
+// our own.
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeNodeNotFound   = -32001
+)
+
+// conn is one client of the control socket.
+type conn struct {
+	tree *processtree.ProcessTree
+
+	// writeL serializes responses and subscription notifications.
+	writeL sync.Mutex
+	enc    *json.Encoder
+
+	subscription *subscription
+}
+
+func serve(tree *processtree.ProcessTree, rw io.ReadWriter) {
+	c := &conn{tree: tree, enc: json.NewEncoder(rw)}
+	defer c.unsubscribe()
+
+	scanner := bufio.NewScanner(rw)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		c.handle(scanner.Bytes())
+	}
+}
+
+func (c *conn) handle(line []byte) {
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		c.write(&response{Error: &rpcError{codeParseError, err.Error()}})
+		return
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		c.write(&response{ID: req.ID, Error: &rpcError{codeInvalidRequest, "Expected a JSON-RPC 2.0 request"}})
+		return
+	}
+
+	result, rpcErr := c.call(req.Method, req.Params)
+	if req.ID == nil {
+		// A notification: the caller wants no response.
+		return
+	}
+	if rpcErr == nil && result == nil {
+		result = json.RawMessage("null")
+	}
+	c.write(&response{ID: req.ID, Result: result, Error: rpcErr})
+}
+
+func (c *conn) write(v interface{}) {
+	switch v := v.(type) {
+	case *response:
+		v.JSONRPC = "2.0"
+	case *notification:
+		v.JSONRPC = "2.0"
+	}
+
+	c.writeL.Lock()
+	defer c.writeL.Unlock()
+	if err := c.enc.Encode(v); err != nil {
+		slog.Trace("control socket write failed: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package controlserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/processtree"
+)
+
+func testTree() *processtree.ProcessTree {
+	tree := &processtree.ProcessTree{SlavesByName: make(map[string]*processtree.SlaveNode)}
+	boot := tree.NewSlaveNode("boot", nil, nil)
+	tree.Root = boot
+	test := tree.NewSlaveNode("test_environment", boot, nil)
+	boot.Slaves = append(boot.Slaves, test)
+	test.Commands = append(test.Commands, tree.NewCommandNode("rspec", []string{"spec"}, test))
+	return tree
+}
+
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func connect(t *testing.T, tree *processtree.ProcessTree) *client {
+	server, conn := net.Pipe()
+	go func() {
+		serve(tree, server)
+		server.Close()
+	}()
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &client{t, conn, bufio.NewReader(conn)}
+}
+
+func (c *client) send(line string) map[string]interface{} {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	reply, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(reply, &v); err != nil {
+		c.t.Fatal(err)
+	}
+	return v
+}
+
+func (c *client) call(method, params string) interface{} {
+	c.t.Helper()
+	reply := c.send(`{"jsonrpc":"2.0","id":7,"method":"` + method + `","params":` + params + `}`)
+	if reply["error"] != nil {
+		c.t.Fatalf("%s: unexpected error %v", method, reply["error"])
+	}
+	if reply["id"] != 7.0 {
+		c.t.Fatalf("%s: expected the request's id, got %v", method, reply["id"])
+	}
+	return reply["result"]
+}
+
+func (c *client) callError(method, params string) float64 {
+	c.t.Helper()
+	reply := c.send(`{"jsonrpc":"2.0","id":7,"method":"` + method + `","params":` + params + `}`)
+	err, ok := reply["error"].(map[string]interface{})
+	if !ok || reply["result"] != nil {
+		c.t.Fatalf("%s: expected an error, got %v", method, reply)
+	}
+	return err["code"].(float64)
+}
+
+func TestTree(t *testing.T) {
+	c := connect(t, testTree())
+	root := c.call("tree", "null").(map[string]interface{})
+	if root["name"] != "boot" || root["state"] != "" {
+		t.Errorf("unexpected root %v", root)
+	}
+	nodes := root["nodes"].([]interface{})
+	if len(nodes) != 1 {
+		t.Fatalf("expected one child, got %v", nodes)
+	}
+	test := nodes[0].(map[string]interface{})
+	commands := test["commands"].([]interface{})
+	if test["name"] != "test_environment" || test["parent"] != "boot" || len(commands) != 1 {
+		t.Fatalf("unexpected node %v", test)
+	}
+	if name := commands[0].(map[string]interface{})["name"]; name != "rspec" {
+		t.Errorf("expected the rspec command, got %v", name)
+	}
+}
+
+func TestStatusAndCommands(t *testing.T) {
+	c := connect(t, testTree())
+	status := c.call("status", "{}").(map[string]interface{})
+	if nodes := status["nodes"].([]interface{}); len(nodes) != 2 {
+		t.Errorf("expected two nodes, got %v", nodes)
+	}
+
+	commands := c.call("commands", "{}").([]interface{})
+	expected := []interface{}{map[string]interface{}{
+		"name": "rspec", "aliases": []interface{}{"spec"}, "node": "test_environment", "runnable": false,
+	}}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v, got %v", expected, commands)
+	}
+}
+
+func TestNodeMethods(t *testing.T) {
+	c := connect(t, testTree())
+	if features := c.call("features", `{"node":"boot"}`).([]interface{}); len(features) != 0 {
+		t.Errorf("expected no features, got %v", features)
+	}
+	if result := c.call("restart", `{"node":"test_environment"}`); result != true {
+		t.Errorf("expected true, got %v", result)
+	}
+
+	if code := c.callError("restart", `{"node":"nope"}`); code != codeNodeNotFound {
+		t.Errorf("expected node not found, got %v", code)
+	}
+	if code := c.callError("features", `{}`); code != codeInvalidParams {
+		t.Errorf("expected invalid params, got %v", code)
+	}
+	if code := c.callError("features", `["boot"]`); code != codeInvalidParams {
+		t.Errorf("expected invalid params, got %v", code)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c := connect(t, testTree())
+	nodes := c.call("subscribe", `{"states":["ready","crashed"]}`).([]interface{})
+	if len(nodes) != 2 {
+		t.Errorf("expected the status of two nodes, got %v", nodes)
+	}
+	if code := c.callError("subscribe", `{"states":["asleep"]}`); code != codeInvalidParams {
+		t.Errorf("expected invalid params, got %v", code)
+	}
+	if result := c.call("unsubscribe", "null"); result != true {
+		t.Errorf("expected true, got %v", result)
+	}
+}
+
+func TestSubscriberResyncsAfterFallingBehind(t *testing.T) {
+	tree := testTree()
+	c := connect(t, tree)
+	c.call("subscribe", "{}")
+
+	// The client doesn't read while the events are published, so most
+	// are dropped.
+	for i := 0; i < 300; i++ {
+		if !tree.ApplyPlan(testTree()) {
+			t.Fatal("expected the plan to apply")
+		}
+	}
+	for i := 0; ; i++ {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("expected a resync, got %v after %d notifications", err, i)
+		}
+		var n struct {
+			Method string
+			Params struct{ Nodes []processtree.NodeStatus }
+		}
+		if err := json.Unmarshal(line, &n); err != nil {
+			t.Fatal(err)
+		}
+		if n.Method == "resync" {
+			if len(n.Params.Nodes) != 2 {
+				t.Errorf("expected the status of two nodes, got %v", n.Params.Nodes)
+			}
+			break
+		}
+		if n.Method != "plan_changed" {
+			t.Fatalf("unexpected notification %s", line)
+		}
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	c := connect(t, testTree())
+	cases := []struct {
+		line string
+		code float64
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"tree"`, codeParseError},
+		{`{"id":1,"method":"tree"}`, codeInvalidRequest},
+		{`{"jsonrpc":"2.0","id":1}`, codeInvalidRequest},
+		{`{"jsonrpc":"2.0","id":1,"method":"explode"}`, codeMethodNotFound},
+	}
+	for _, tc := range cases {
+		reply := c.send(tc.line)
+		err, ok := reply["error"].(map[string]interface{})
+		if !ok || err["code"] != tc.code {
+			t.Errorf("%s: expected error %v, got %v", tc.line, tc.code, reply)
+		}
+	}
+
+	// Notifications get no reply, so the next reply is for the next
+	// request.
+	c.conn.Write([]byte(`{"jsonrpc":"2.0","method":"restart","params":{"node":"boot"}}` + "\n"))
+	if result := c.call("unsubscribe", "null"); result != true {
+		t.Errorf("expected true, got %v", result)
+	}
+}
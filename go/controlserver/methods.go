@@ -0,0 +1,107 @@
+package controlserver
+
+import (
+	"encoding/json"
+
+	"github.com/burke/zeus/go/processtree"
+)
+
+func (c *conn) call(method string, params json.RawMessage) (interface{}, *rpcError) {
+	switch method {
+	case "status":
+		return c.tree.Status(), nil
+	case "tree":
+		return buildTree(c.tree.Status()), nil
+	case "commands":
+		return c.tree.Status().Commands, nil
+	case "features":
+		return c.features(params)
+	case "restart":
+		return c.restart(params)
+	case "subscribe":
+		return c.subscribe(params)
+	case "unsubscribe":
+		c.unsubscribe()
+		return true, nil
+	default:
+		return nil, &rpcError{codeMethodNotFound, "Unknown method: " + method}
+	}
+}
+
+// treeNode is a node's status, with its commands and child nodes.
+type treeNode struct {
+	processtree.NodeStatus
+	Commands []processtree.CommandStatus `json:"commands"`
+	Nodes    []*treeNode                 `json:"nodes"`
+}
+
+// buildTree nests the nodes of a status snapshot, returning the root.
+func buildTree(status *processtree.TreeStatus) *treeNode {
+	nodes := make(map[string]*treeNode, len(status.Nodes))
+	var root *treeNode
+	// Nodes are listed depth-first, so parents come before children.
+	for _, node := range status.Nodes {
+		n := &treeNode{NodeStatus: node, Commands: []processtree.CommandStatus{}, Nodes: []*treeNode{}}
+		nodes[node.Name] = n
+		if parent := nodes[node.Parent]; node.Parent != "" && parent != nil {
+			parent.Nodes = append(parent.Nodes, n)
+		} else if root == nil {
+			root = n
+		}
+	}
+	for _, command := range status.Commands {
+		if n := nodes[command.Node]; n != nil {
+			n.Commands = append(n.Commands, command)
+		}
+	}
+	return root
+}
+
+type nodeParams struct {
+	Node string `json:"node"`
+}
+
+// findNode looks up the node named in params.
+func (c *conn) findNode(params json.RawMessage) (*processtree.SlaveNode, *rpcError) {
+	var p nodeParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	if p.Node == "" {
+		return nil, &rpcError{codeInvalidParams, "Expected the name of a node"}
+	}
+	slave := c.tree.FindSlaveByName(p.Node)
+	if slave == nil {
+		return nil, &rpcError{codeNodeNotFound, "Node not found: " + p.Node}
+	}
+	return slave, nil
+}
+
+func (c *conn) features(params json.RawMessage) (interface{}, *rpcError) {
+	slave, err := c.findNode(params)
+	if err != nil {
+		return nil, err
+	}
+	return slave.Features(), nil
+}
+
+// restart restarts a node. As with a file change, the node's
+// descendants are restarted along with it.
+func (c *conn) restart(params json.RawMessage) (interface{}, *rpcError) {
+	slave, err := c.findNode(params)
+	if err != nil {
+		return nil, err
+	}
+	slave.RequestRestart()
+	return true, nil
+}
+
+func decodeParams(params json.RawMessage, v interface{}) *rpcError {
+	if len(params) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{codeInvalidParams, "Expected params as an object: " + err.Error()}
+	}
+	return nil
+}
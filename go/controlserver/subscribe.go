@@ -0,0 +1,145 @@
+package controlserver
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/burke/zeus/go/processtree"
+)
+
+// The states a node can report in NodeStatus.State.
+var knownStates = map[string]bool{"unbooted": true, "booted": true, "ready": true, "crashed": true}
+
+type subscription struct {
+	quit chan struct{}
+	sub  *processtree.Subscription
+}
+
+type subscribeParams struct {
+	// States limits notifications to nodes entering these states. All
+	// changes are reported if it is empty.
+	States []string `json:"states"`
+}
+
+// stateChange is the params of a state_changed notification.
+type stateChange struct {
+	Node     string    `json:"node"`
+	OldState string    `json:"old_state"`
+	State    string    `json:"state"`
+	Pid      int       `json:"pid"`
+	Error    string    `json:"error,omitempty"`
+	Files    []string  `json:"files,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// resync is the params of a resync notification, sent in place of the
+// events a subscriber missed because it fell behind.
+type resync struct {
+	Nodes []processtree.NodeStatus `json:"nodes"`
+	Time  time.Time                `json:"time"`
+}
+
+// monitorDegraded is the params of a file_monitor_degraded notification.
+type monitorDegraded struct {
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// subscribe sends a state_changed notification whenever a node changes
+// state, a plan_changed notification when the config file is reloaded,
+// and a file_monitor_degraded notification when the file monitor starts
+// watching files less well than it should, until the client unsubscribes
+// or hangs up. It replies with the status of every node, so that the
+// client starts from a consistent picture, and sends a resync with it
+// again if the client falls behind. Subscribing again replaces the
+// filter.
+func (c *conn) subscribe(params json.RawMessage) (interface{}, *rpcError) {
+	var p subscribeParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	var states map[string]bool
+	for _, state := range p.States {
+		if !knownStates[state] {
+			return nil, &rpcError{codeInvalidParams, "Unknown state: " + state}
+		}
+		if states == nil {
+			states = make(map[string]bool)
+		}
+		states[state] = true
+	}
+
+	c.unsubscribe()
+	// Subscribe before taking the snapshot, so no change falls between
+	// them.
+	sub := &subscription{quit: make(chan struct{}), sub: c.tree.Subscribe()}
+	nodes := c.tree.Status().Nodes
+	c.subscription = sub
+	go c.notifyEvents(sub, states)
+
+	return nodes, nil
+}
+
+func (c *conn) unsubscribe() {
+	if c.subscription == nil {
+		return
+	}
+	close(c.subscription.quit)
+	c.subscription.sub.Close()
+	c.subscription = nil
+}
+
+func (c *conn) notifyEvents(sub *subscription, states map[string]bool) {
+	dropped := 0
+	for {
+		var event processtree.Event
+		select {
+		case event = <-sub.sub.C:
+		case <-sub.quit:
+			return
+		}
+
+		if d := sub.sub.Dropped(); d > dropped {
+			// The client fell behind and missed events, so the states
+			// it knows may be wrong. Those still queued are older than
+			// a fresh status, so send that instead.
+			dropped = d
+			for len(sub.sub.C) > 0 {
+				<-sub.sub.C
+			}
+			c.write(&notification{Method: "resync", Params: &resync{Nodes: c.tree.Status().Nodes, Time: time.Now()}})
+			continue
+		}
+
+		var n *notification
+		switch event.Kind {
+		case processtree.EventPlanChanged:
+			n = &notification{Method: "plan_changed", Params: map[string]time.Time{"time": event.Time}}
+		case processtree.EventFileMonitorDegraded:
+			n = &notification{Method: "file_monitor_degraded", Params: &monitorDegraded{Reason: event.Error, Time: event.Time}}
+		case processtree.EventStateChanged:
+			state := processtree.StateName(event.State)
+			if states != nil && !states[state] {
+				continue
+			}
+			n = &notification{Method: "state_changed", Params: &stateChange{
+				Node:     event.Node,
+				OldState: processtree.StateName(event.OldState),
+				State:    state,
+				Pid:      event.Pid,
+				Error:    event.Error,
+				Files:    event.Files,
+				Time:     event.Time,
+			}}
+		default:
+			continue
+		}
+
+		select {
+		case <-sub.quit:
+			return
+		default:
+		}
+		c.write(n)
+	}
+}
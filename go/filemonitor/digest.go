@@ -0,0 +1,175 @@
+package filemonitor
+
+import (
+	"os"
+	"sync"
+
+	slog "github.com/burke/zeus/go/shinylog"
+)
+
+// contentDigests remembers the contents of watched files, so that
+// changes that leave a file as it was, like touching it, saving it
+// unchanged, or checking out a branch and back, can be dropped rather
+// than restarting nodes. Files are hashed in the background, as they
+// are added while slaves boot, and a file whose hash isn't known yet is
+// always taken to have changed.
+type contentDigests struct {
+	once  sync.Once
+	mu    sync.Mutex
+	files map[string]digest
+	// pending lists the files waiting to be hashed. It's guarded by mu,
+	// and wake tells the hashing goroutine there are more.
+	pending []string
+	wake    chan struct{}
+	stop    chan struct{}
+
+	suppressed int
+}
+
+type digest struct {
+	state  fileState
+	hashed bool
+}
+
+func (d *contentDigests) init() {
+	d.once.Do(func() {
+		d.files = make(map[string]digest)
+		d.wake = make(chan struct{}, 1)
+		d.stop = make(chan struct{})
+		go d.hashPending()
+	})
+}
+
+// remember records the state of a file as it's added to the monitor,
+// and queues it to be hashed.
+func (d *contentDigests) remember(file string) {
+	d.init()
+	state := statFile(file, false)
+	if !state.exists || state.entries != nil {
+		return // nothing to compare, or a directory
+	}
+
+	d.mu.Lock()
+	if _, ok := d.files[file]; ok {
+		d.mu.Unlock()
+		return
+	}
+	d.files[file] = digest{state: state}
+	// However many files slaves load while booting, every one is
+	// hashed, or its first change would never be dropped.
+	d.pending = append(d.pending, file)
+	d.mu.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *contentDigests) hashPending() {
+	for {
+		select {
+		case <-d.wake:
+		case <-d.stop:
+			return
+		}
+
+		d.mu.Lock()
+		files := d.pending
+		d.pending = nil
+		d.mu.Unlock()
+
+		for _, file := range files {
+			select {
+			case <-d.stop:
+				return
+			default:
+			}
+			d.hash(file)
+		}
+	}
+}
+
+// hash records the hash of a file waiting to be hashed.
+func (d *contentDigests) hash(file string) {
+	state := statFile(file, true)
+	after := statFile(file, false)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// If the file changed since it was added, or while it was being
+	// hashed, the hash may not be of the contents that were loaded.
+	if old, ok := d.files[file]; ok && !old.hashed && unmodified(old.state, state) && unmodified(state, after) {
+		d.files[file] = digest{state: state, hashed: true}
+	}
+}
+
+// unchanged reports whether file has the same contents as when it was
+// last seen, updating them if not.
+func (d *contentDigests) unchanged(file string) bool {
+	d.init()
+	d.mu.Lock()
+	old, ok := d.files[file]
+	d.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	state := statFile(file, true)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if old.hashed && sameFile(old.state, state) {
+		d.suppressed++
+		slog.Trace("ignoring a change to %s: its contents are the same (%d changes ignored so far)", file, d.suppressed)
+		return true
+	}
+	if state.exists {
+		d.files[file] = digest{state: state, hashed: true}
+	} else {
+		delete(d.files, file)
+	}
+	return false
+}
+
+// close stops hashing files.
+func (d *contentDigests) close() {
+	d.init()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.stop:
+	default:
+		close(d.stop)
+	}
+}
+
+// sameFile reports whether two states of a file have the same contents,
+// ignoring when it was modified.
+func sameFile(a, b fileState) bool {
+	return a.exists == b.exists && a.size == b.size && a.sum == b.sum
+}
+
+func unmodified(a, b fileState) bool {
+	return a.exists == b.exists && a.size == b.size && a.modTime.Equal(b.modTime)
+}
+
+// statFile returns the state of file, hashing its contents if hash is
+// set.
+func statFile(file string, hash bool) fileState {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileState{}
+	}
+	state := fileState{exists: true, modTime: info.ModTime(), size: info.Size()}
+	if hash && info.Mode().IsRegular() {
+		state.sum = hashFile(file)
+	}
+	if info.IsDir() {
+		state.entries = make(map[string]bool)
+		if entries, err := os.ReadDir(file); err == nil {
+			for _, entry := range entries {
+				state.entries[entry.Name()] = true
+			}
+		}
+	}
+	return state
+}
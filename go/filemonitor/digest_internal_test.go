@@ -0,0 +1,57 @@
+package filemonitor
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEveryFileIsHashed(t *testing.T) {
+	// Far more files than the hashing goroutine can keep up with as
+	// they're added, as when a large app boots.
+	dir := t.TempDir()
+	files := make([]string, 12288)
+	for i := range files {
+		files[i] = filepath.Join(dir, fmt.Sprintf("file%d", i))
+		if err := os.WriteFile(files[i], []byte("foo"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var d contentDigests
+	defer d.close()
+	for _, file := range files {
+		d.remember(file)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		unhashed := 0
+		d.mu.Lock()
+		for _, file := range files {
+			if !d.files[file].hashed {
+				unhashed++
+			}
+		}
+		d.mu.Unlock()
+		if unhashed == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d files were never hashed", unhashed, len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// So the first touch of any of them is dropped.
+	last := files[len(files)-1]
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(last, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if !d.unchanged(last) {
+		t.Error("expected touching the last file added not to count as a change")
+	}
+}
@@ -0,0 +1,55 @@
+package filemonitor_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+func TestUnchangedContentsAreIgnored(t *testing.T) {
+	files, err := writeTestFiles(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm := filemonitor.NewPollingMonitor(10*time.Millisecond, testPollInterval, false)
+	defer fm.Close()
+	for _, file := range files {
+		if err := fm.Add(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := fm.Listen()
+	time.Sleep(20 * time.Millisecond)
+
+	// Touched, and rewritten with the same contents.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(files[0], later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files[1], []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case list := <-changes:
+		t.Fatalf("expected no changes, got %v", list)
+	case <-time.After(10 * testPollInterval):
+	}
+
+	// Real changes are still reported, including changing it back.
+	if err := ioutil.WriteFile(files[0], []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectChanges(changes, files[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(files[0], []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectChanges(changes, files[:1]); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !darwin
+// +build !darwin
+
+package filemonitor
+
+import (
+	"sync"
+	"syscall"
+)
+
+// LimitWatches makes fm, a native monitor, run out of inotify watches
+// after n more.
+func LimitWatches(fm FileMonitor, n int) {
+	f := fm.(*fsnotifyMonitor)
+	add := f.addWatch
+	var mu sync.Mutex
+	f.addWatch = func(file string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if n == 0 {
+			return syscall.ENOSPC
+		}
+		n--
+		return add(file)
+	}
+}
@@ -35,6 +35,11 @@ func NewFileListener(fileChangeDelay time.Duration, ln net.Listener) FileMonitor
 }
 
 func (f *fileListener) Add(file string) error {
+	if f.ignored(file) {
+		return nil
+	}
+	f.digests.remember(file)
+
 	f.Lock()
 	defer f.Unlock()
 
@@ -1,21 +1,164 @@
 package filemonitor
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
+
+	slog "github.com/burke/zeus/go/shinylog"
 )
 
 const DefaultFileChangeDelay = 300 * time.Millisecond
 
+// Backends that Options can choose.
+const (
+	// BackendNative uses inotify, or FSEvents on macOS.
+	BackendNative = "native"
+	// BackendPoll polls files; see NewPollingMonitor.
+	BackendPoll = "poll"
+	// BackendWatchman uses a watchman daemon; see NewWatchmanMonitor.
+	BackendWatchman = "watchman"
+)
+
+// Environment variables that set the defaults for Options.
+const (
+	backendVar      = "ZEUS_FILE_MONITOR"
+	pollIntervalVar = "ZEUS_POLL_INTERVAL"
+	pollHashVar     = "ZEUS_POLL_HASH"
+	// watchmanSockVar is watchman's own.
+	watchmanSockVar = "WATCHMAN_SOCK"
+)
+
+// Options choose and tune the file monitor.
+type Options struct {
+	Backend string
+	// FileChangeDelay is how long changes are collected for before
+	// they are reported together.
+	FileChangeDelay time.Duration
+	// PollInterval and PollHash tune BackendPoll.
+	PollInterval time.Duration
+	PollHash     bool
+	// WatchmanSocket is the socket BackendWatchman connects to. If it's
+	// empty, watchman is asked.
+	WatchmanSocket string
+}
+
+// OptionsFromEnv returns the default options, overridden by the
+// ZEUS_FILE_MONITOR, ZEUS_POLL_INTERVAL, ZEUS_POLL_HASH and WATCHMAN_SOCK
+// environment variables.
+func OptionsFromEnv() (Options, error) {
+	opts := Options{
+		Backend:         BackendNative,
+		FileChangeDelay: DefaultFileChangeDelay,
+		PollInterval:    DefaultPollInterval,
+		WatchmanSocket:  os.Getenv(watchmanSockVar),
+	}
+	if backend := os.Getenv(backendVar); backend != "" {
+		opts.Backend = backend
+	}
+	if interval := os.Getenv(pollIntervalVar); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be a duration, like 2s: %v", pollIntervalVar, err)
+		}
+		opts.PollInterval = d
+	}
+	if hash := os.Getenv(pollHashVar); hash != "" {
+		b, err := strconv.ParseBool(hash)
+		if err != nil {
+			return opts, fmt.Errorf("%s must be true or false: %v", pollHashVar, err)
+		}
+		opts.PollHash = b
+	}
+	return opts, nil
+}
+
+// New builds the file monitor opts choose.
+func New(opts Options) (FileMonitor, error) {
+	switch opts.Backend {
+	case BackendNative, "":
+		monitor, err := NewFileMonitor(opts.FileChangeDelay)
+		if watchesExhausted(err) {
+			// Too many inotify instances. Zeus is still usable if it
+			// polls instead.
+			slog.Trace("couldn't start the native file monitor: %v; polling instead", err)
+			poll := newPollingMonitor(opts.FileChangeDelay, DefaultPollInterval, false)
+			poll.setDegraded("the native file monitor couldn't start (" + err.Error() + "), so files are polled instead")
+			return poll, nil
+		}
+		return monitor, err
+	case BackendPoll:
+		if opts.PollInterval <= 0 {
+			return nil, fmt.Errorf("the poll interval must be positive, not %v", opts.PollInterval)
+		}
+		return NewPollingMonitor(opts.FileChangeDelay, opts.PollInterval, opts.PollHash), nil
+	case BackendWatchman:
+		return NewWatchmanMonitor(opts.FileChangeDelay, opts.WatchmanSocket)
+	default:
+		return nil, fmt.Errorf("unknown file monitor %q; expected %q, %q or %q", opts.Backend, BackendNative, BackendPoll, BackendWatchman)
+	}
+}
+
 type FileMonitor interface {
 	Listen() <-chan []string
 	Add(string) error
 	Close() error
+	// SetIgnore replaces the rules for files to skip, which may be
+	// nil. Ignored files are not watched by Add, and changes to them
+	// are not reported.
+	SetIgnore(*Ignore)
+	// Degraded explains how the monitor is watching files less well
+	// than it should, such as polling them because inotify's limit on
+	// watches was reached. It is empty if the monitor is working as
+	// intended.
+	Degraded() string
+}
+
+// watchesExhausted reports whether err is inotify running out of
+// watches or instances.
+func watchesExhausted(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
 }
 
 type fileMonitor struct {
 	listeners     []chan []string
 	listenerMutex sync.Mutex
+
+	ignoreMutex sync.RWMutex
+	ignore      *Ignore
+
+	digests contentDigests
+
+	degradedMutex sync.Mutex
+	degraded      string
+}
+
+func (f *fileMonitor) Degraded() string {
+	f.degradedMutex.Lock()
+	defer f.degradedMutex.Unlock()
+	return f.degraded
+}
+
+func (f *fileMonitor) setDegraded(reason string) {
+	f.degradedMutex.Lock()
+	defer f.degradedMutex.Unlock()
+	f.degraded = reason
+}
+
+func (f *fileMonitor) SetIgnore(ignore *Ignore) {
+	f.ignoreMutex.Lock()
+	defer f.ignoreMutex.Unlock()
+	f.ignore = ignore
+}
+
+func (f *fileMonitor) ignored(file string) bool {
+	f.ignoreMutex.RLock()
+	defer f.ignoreMutex.RUnlock()
+	return f.ignore.Match(file)
 }
 
 func (f *fileMonitor) Listen() <-chan []string {
@@ -48,6 +191,7 @@ func (f *gatheringMonitor) serveListeners() {
 		case change := <-f.changes:
 			// Channel closed
 			if change == "" {
+				f.digests.close()
 				f.listenerMutex.Lock()
 				defer f.listenerMutex.Unlock()
 
@@ -57,22 +201,32 @@ func (f *gatheringMonitor) serveListeners() {
 				return
 			}
 
+			if f.ignored(change) {
+				continue
+			}
 			collected[change] = true
 			if deadline == never {
 				deadline = time.After(f.fileChangeDelay)
 			}
 		case <-deadline:
 			list := make([]string, 0, len(collected))
-			for f := range collected {
-				list = append(list, f)
+			for file := range collected {
+				if !f.digests.unchanged(file) {
+					list = append(list, file)
+				}
+			}
+			deadline = never
+			collected = make(map[string]bool, 1)
+			if len(list) == 0 {
+				continue
 			}
 
-			for _, l := range f.listeners {
+			f.listenerMutex.Lock()
+			listeners := f.listeners
+			f.listenerMutex.Unlock()
+			for _, l := range listeners {
 				l <- list
 			}
-
-			deadline = never
-			collected = make(map[string]bool, 1)
 		}
 	}
 }
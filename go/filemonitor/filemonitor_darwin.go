@@ -11,7 +11,7 @@ import (
 	"github.com/fsnotify/fsevents"
 )
 
-const flagsWorthReloadingFor = fsevents.ItemRemoved | fsevents.ItemModified | fsevents.ItemRenamed
+const flagsWorthReloadingFor = fsevents.ItemCreated | fsevents.ItemRemoved | fsevents.ItemModified | fsevents.ItemRenamed
 
 type fsEventsMonitor struct {
 	fileMonitor
@@ -40,6 +40,11 @@ func NewFileMonitor(fileChangeDelay time.Duration) (FileMonitor, error) {
 }
 
 func (f *fsEventsMonitor) Add(file string) error {
+	if f.ignored(file) {
+		return nil
+	}
+	f.digests.remember(file)
+
 	select {
 	case <-f.stop:
 		return nil // Monitor is closed
@@ -54,6 +59,7 @@ func (f *fsEventsMonitor) Close() error {
 		return nil // Already stopped
 	default:
 		close(f.stop)
+		f.digests.close()
 	}
 
 	return nil
@@ -68,6 +74,9 @@ func (f *fsEventsMonitor) watch() {
 				if (event.Flags & (fsevents.ItemIsFile | flagsWorthReloadingFor)) == 0 {
 					continue
 				}
+				if f.ignored(event.Path) || f.digests.unchanged(event.Path) {
+					continue
+				}
 
 				paths = append(paths, event.Path)
 			}
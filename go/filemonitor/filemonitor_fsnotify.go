@@ -4,17 +4,37 @@
 package filemonitor
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	slog "github.com/burke/zeus/go/shinylog"
 	"github.com/fsnotify/fsnotify"
 )
 
+// fsnotifyMonitor watches each file with inotify. When inotify runs out
+// of watches (fs.inotify.max_user_watches), files are watched through
+// their directories instead, which share one watch, and once even that
+// fails they are polled.
 type fsnotifyMonitor struct {
 	gatheringMonitor
 	watcher *fsnotify.Watcher
+	// addWatch is watcher.Add, unless a test limits the watches.
+	addWatch func(string) error
+
+	mu sync.Mutex
+	// dirWatches are the directories watched in place of their files.
+	dirWatches map[string]bool
+	overflow   *pollingMonitor
+	polled     map[string]bool
+	closed     bool
+	forwarding sync.WaitGroup
 }
 
-const flagsWorthReloadingFor = fsnotify.Write | fsnotify.Remove | fsnotify.Rename
+// Create is only reported for files created in watched directories.
+const flagsWorthReloadingFor = fsnotify.Write | fsnotify.Remove | fsnotify.Rename | fsnotify.Create
 
 func NewFileMonitor(fileChangeDelay time.Duration) (FileMonitor, error) {
 	watcher, err := fsnotify.NewWatcher()
@@ -23,7 +43,10 @@ func NewFileMonitor(fileChangeDelay time.Duration) (FileMonitor, error) {
 	}
 
 	f := fsnotifyMonitor{
-		watcher: watcher,
+		watcher:    watcher,
+		addWatch:   watcher.Add,
+		dirWatches: make(map[string]bool),
+		polled:     make(map[string]bool),
 	}
 	f.fileChangeDelay = fileChangeDelay
 	f.changes = make(chan string)
@@ -35,14 +58,90 @@ func NewFileMonitor(fileChangeDelay time.Duration) (FileMonitor, error) {
 }
 
 func (f *fsnotifyMonitor) Add(file string) error {
-	if err := f.watcher.Add(file); err != nil {
+	if f.ignored(file) {
+		return nil
+	}
+	f.digests.remember(file)
+
+	f.mu.Lock()
+	covered := f.dirWatches[filepath.Dir(file)]
+	f.mu.Unlock()
+	if covered {
+		return nil
+	}
+
+	err := f.addWatch(file)
+	if watchesExhausted(err) {
+		return f.addOverflow(file, err)
+	}
+	return err
+}
+
+// addOverflow watches file once inotify has no watches left for it:
+// through its directory if that can still be watched, and otherwise by
+// polling it.
+func (f *fsnotifyMonitor) addOverflow(file string, err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return err
+	}
+
+	dir := filepath.Dir(file)
+	if f.dirWatches[dir] {
+		return nil
+	}
+	if dirErr := f.addWatch(dir); dirErr == nil {
+		f.dirWatches[dir] = true
+		slog.Trace("out of inotify watches (%v): watching %s through its directory; %d directories are watched in place of their files", err, file, len(f.dirWatches))
+		f.degrade()
+		return nil
+	} else if !watchesExhausted(dirErr) {
 		return err
 	}
 
+	if f.overflow == nil {
+		f.overflow = newPollingMonitor(0, DefaultPollInterval, false)
+		changes := f.overflow.Listen()
+		f.forwarding.Add(1)
+		go func() {
+			defer f.forwarding.Done()
+			for files := range changes {
+				for _, file := range files {
+					f.changes <- file
+				}
+			}
+		}()
+	}
+	if f.polled[file] {
+		return nil
+	}
+	if err := f.overflow.Add(file); err != nil {
+		return err
+	}
+	f.polled[file] = true
+	slog.Trace("out of inotify watches (%v): polling %s; %d files are polled", err, file, len(f.polled))
+	f.degrade()
 	return nil
 }
 
+// degrade explains how files are being watched now that inotify is out
+// of watches. f.mu must be held.
+func (f *fsnotifyMonitor) degrade() {
+	how := "some files are watched through their directories"
+	if f.overflow != nil {
+		how = "some files are polled every " + DefaultPollInterval.String()
+	}
+	f.setDegraded(fmt.Sprintf("inotify ran out of watches, so %s; raise fs.inotify.max_user_watches", how))
+}
+
 func (f *fsnotifyMonitor) Close() error {
+	f.mu.Lock()
+	f.closed = true
+	if f.overflow != nil {
+		f.overflow.Close()
+	}
+	f.mu.Unlock()
 	return f.watcher.Close()
 }
 
@@ -54,9 +153,21 @@ func (f *fsnotifyMonitor) watch() {
 		if (event.Op & flagsWorthReloadingFor) == 0 {
 			continue
 		}
+		if (event.Op & (fsnotify.Remove | fsnotify.Rename)) != 0 {
+			// Editors often replace a file rather than writing to it,
+			// which ends its watch. Watch the new one, in case the
+			// change turns out to leave its contents the same and no
+			// node restarts to add it again. If inotify is out of
+			// watches, Add falls back as it does for any other file.
+			// A file that was deleted has nothing left to watch.
+			if err := f.Add(event.Name); err != nil && !os.IsNotExist(err) {
+				slog.Trace("couldn't watch %s again: %v", event.Name, err)
+			}
+		}
 
 		f.changes <- event.Name
 	}
 
+	f.forwarding.Wait()
 	close(f.changes)
 }
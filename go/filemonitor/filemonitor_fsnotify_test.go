@@ -0,0 +1,129 @@
+//go:build !darwin
+// +build !darwin
+
+package filemonitor_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+func TestFileMonitorOutOfWatches(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, dir := range []string{"a", "b"} {
+		dir = filepath.Join(root, dir)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		written, err := writeTestFiles(dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, written...)
+	}
+
+	fm, err := filemonitor.NewFileMonitor(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+
+	// a/file0 gets its own watch and a/file1 is watched through a; b's
+	// files are polled.
+	filemonitor.LimitWatches(fm, 2)
+	for i, file := range files {
+		if err := fm.Add(file); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if i == 0 && fm.Degraded() != "" {
+			t.Fatalf("expected the monitor to work as intended, got %q", fm.Degraded())
+		}
+	}
+	if degraded := fm.Degraded(); !strings.Contains(degraded, "polled") {
+		t.Errorf("expected the monitor to say files are polled, got %q", degraded)
+	}
+
+	changes := fm.Listen()
+	time.Sleep(20 * time.Millisecond)
+	for _, file := range files {
+		if err := ioutil.WriteFile(file, []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	timeout := time.After(3 * filemonitor.DefaultPollInterval)
+	for len(seen) < len(files) {
+		select {
+		case changed := <-changes:
+			for _, file := range changed {
+				seen[file] = true
+			}
+		case <-timeout:
+			t.Fatalf("expected changes to %v, got %v", files, seen)
+		}
+	}
+	var got []string
+	for file := range seen {
+		got = append(got, file)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, files) {
+		t.Errorf("expected changes to %v, got %v", files, got)
+	}
+}
+
+func TestFileMonitorOutOfWatchesAfterReplace(t *testing.T) {
+	files, err := writeTestFiles(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := files[0]
+
+	fm, err := filemonitor.NewFileMonitor(10 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	filemonitor.LimitWatches(fm, 1)
+	if err := fm.Add(file); err != nil {
+		t.Fatal(err)
+	}
+	changes := fm.Listen()
+	time.Sleep(20 * time.Millisecond)
+
+	// Saving atomically replaces the file, which ends its watch, and
+	// there's none left to watch the new one with.
+	for i, contents := range []string{"saved", "saved again"} {
+		tmp := file + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case changed := <-changes:
+			if !reflect.DeepEqual(changed, []string{file}) {
+				t.Fatalf("%d: expected a change to %s, got %v", i, file, changed)
+			}
+		case <-time.After(3 * filemonitor.DefaultPollInterval):
+			t.Fatalf("%d: expected a change to %s", i, file)
+		}
+	}
+	if degraded := fm.Degraded(); !strings.Contains(degraded, "polled") {
+		t.Errorf("expected the monitor to say files are polled, got %q", degraded)
+	}
+}
@@ -0,0 +1,171 @@
+package filemonitor
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DefaultPollInterval = time.Second
+
+// pollingMonitor checks each file's modification time and size (and
+// optionally a hash of its contents) every interval. It works on
+// filesystems where inotify and FSEvents don't, like NFS, 9p, and
+// vboxsf mounts, at the cost of some CPU and latency.
+type pollingMonitor struct {
+	gatheringMonitor
+	interval time.Duration
+	hash     bool
+
+	mu    sync.Mutex
+	files map[string]fileState
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type fileState struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+	// entries are the names in a directory, so that files created in
+	// it can be reported as other monitors do.
+	entries map[string]bool
+}
+
+// NewPollingMonitor returns a FileMonitor that polls files every
+// interval. With hash, it also compares their contents, which catches
+// changes that leave the size and modification time alone, such as on
+// filesystems with coarse timestamps.
+func NewPollingMonitor(fileChangeDelay, interval time.Duration, hash bool) FileMonitor {
+	return newPollingMonitor(fileChangeDelay, interval, hash)
+}
+
+func newPollingMonitor(fileChangeDelay, interval time.Duration, hash bool) *pollingMonitor {
+	f := pollingMonitor{
+		interval: interval,
+		hash:     hash,
+		files:    make(map[string]fileState),
+		stop:     make(chan struct{}),
+	}
+	f.fileChangeDelay = fileChangeDelay
+	f.changes = make(chan string)
+
+	go f.serveListeners()
+	go f.poll()
+
+	return &f
+}
+
+// Add starts watching file. Unlike the other monitors, it can watch a
+// file that doesn't exist yet, and reports when it appears.
+func (f *pollingMonitor) Add(file string) error {
+	if f.ignored(file) {
+		return nil
+	}
+	f.digests.remember(file)
+
+	f.mu.Lock()
+	_, ok := f.files[file]
+	f.mu.Unlock()
+	if ok {
+		return nil
+	}
+
+	state := statFile(file, f.hash)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.files[file]; !ok {
+		f.files[file] = state
+	}
+	return nil
+}
+
+func (f *pollingMonitor) Close() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+	return nil
+}
+
+func (f *pollingMonitor) poll() {
+	defer close(f.changes)
+
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		files := make([]string, 0, len(f.files))
+		for file := range f.files {
+			files = append(files, file)
+		}
+		f.mu.Unlock()
+
+		for _, file := range files {
+			state := statFile(file, f.hash)
+
+			f.mu.Lock()
+			old := f.files[file]
+			f.files[file] = state
+			f.mu.Unlock()
+
+			if !state.differsFrom(old) {
+				continue
+			}
+			for _, change := range append([]string{file}, state.entriesChanged(file, old)...) {
+				select {
+				case f.changes <- change:
+				case <-f.stop:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s fileState) differsFrom(other fileState) bool {
+	return s.exists != other.exists || !s.modTime.Equal(other.modTime) || s.size != other.size || s.sum != other.sum ||
+		len(s.entriesChanged("", other)) > 0
+}
+
+// entriesChanged returns the paths of the entries created in or removed
+// from dir since old.
+func (s fileState) entriesChanged(dir string, old fileState) []string {
+	var changed []string
+	for name := range s.entries {
+		if !old.entries[name] {
+			changed = append(changed, filepath.Join(dir, name))
+		}
+	}
+	for name := range old.entries {
+		if !s.entries[name] {
+			changed = append(changed, filepath.Join(dir, name))
+		}
+	}
+	return changed
+}
+
+func hashFile(file string) (sum [sha256.Size]byte) {
+	r, err := os.Open(file)
+	if err != nil {
+		return sum
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return sum
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
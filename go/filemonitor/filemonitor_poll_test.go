@@ -0,0 +1,132 @@
+package filemonitor_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+const testPollInterval = 10 * time.Millisecond
+
+func TestPollingMonitor(t *testing.T) {
+	files, err := writeTestFiles(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(filepath.Dir(files[0]), "missing")
+
+	fm := filemonitor.NewPollingMonitor(10*time.Millisecond, testPollInterval, false)
+	defer fm.Close()
+	for _, file := range append(files, missing) {
+		if err := fm.Add(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := fm.Listen()
+
+	if err := ioutil.WriteFile(files[0], []byte("longer"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(missing, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectChanges(changes, []string{files[0], files[1], missing}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files created in a watched directory are reported by name, along
+	// with the directory.
+	dir := filepath.Dir(files[0])
+	if err := fm.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(dir, "created")
+	if err := ioutil.WriteFile(created, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectChanges(changes, []string{dir, created}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A change to the modification time is enough to notice a change
+	// that leaves the size alone.
+	if err := ioutil.WriteFile(files[2], []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(files[2], later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectChanges(changes, []string{files[2]}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollingMonitorHash(t *testing.T) {
+	files, err := writeTestFiles(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm := filemonitor.NewPollingMonitor(10*time.Millisecond, testPollInterval, true)
+	defer fm.Close()
+	for _, file := range files {
+		fm.Add(file)
+	}
+	changes := fm.Listen()
+	// Give the monitor time to hash the files, as it would have long
+	// before anyone edits them.
+	time.Sleep(20 * time.Millisecond)
+
+	// Same size and modification time, as on a filesystem with coarse
+	// timestamps: only the contents tell.
+	if err := ioutil.WriteFile(files[0], []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(files[0], info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err := expectChanges(changes, []string{files[0]}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPollingMonitorClose(t *testing.T) {
+	fm := filemonitor.NewPollingMonitor(10*time.Millisecond, testPollInterval, false)
+	changes := fm.Listen()
+	fm.Close()
+
+	select {
+	case _, ok := <-changes:
+		if ok {
+			t.Fatal("expected no changes")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected closing the monitor to close its listeners")
+	}
+}
+
+func TestNewChoosesBackend(t *testing.T) {
+	if _, err := filemonitor.New(filemonitor.Options{Backend: "telepathy"}); err == nil {
+		t.Error("expected an unknown backend to be an error")
+	}
+	if _, err := filemonitor.New(filemonitor.Options{Backend: filemonitor.BackendPoll}); err == nil {
+		t.Error("expected a zero poll interval to be an error")
+	}
+	fm, err := filemonitor.New(filemonitor.Options{Backend: filemonitor.BackendPoll, PollInterval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Close()
+}
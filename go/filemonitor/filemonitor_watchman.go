@@ -0,0 +1,380 @@
+package filemonitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	slog "github.com/burke/zeus/go/shinylog"
+)
+
+// watchmanSubscription is the name of the subscription made on each
+// watched root.
+const watchmanSubscription = "zeus"
+
+// watchmanTimeout bounds how long a command to watchman may take.
+const watchmanTimeout = 30 * time.Second
+
+// watchmanMonitor asks a watchman daemon to watch files, over its JSON
+// protocol. Watchman watches whole directory trees, and so isn't bound
+// by inotify's limit on watches as the native monitor is.
+//
+// Each file is watched by watching its project (the directory above it
+// with a .git, .watchmanconfig, or the like) and subscribing to changes
+// in it, from the clock when it was first watched. Changes to files
+// other than those added are dropped, except for files created in
+// directories that were added.
+//
+// If the connection to watchman is lost, or a command to it times out,
+// the files and directories added are polled instead, and the monitor
+// reports itself degraded.
+type watchmanMonitor struct {
+	gatheringMonitor
+	conn net.Conn
+
+	// requestL serializes commands, each of which waits for its reply
+	// on replies.
+	requestL sync.Mutex
+	replies  chan map[string]interface{}
+
+	mu    sync.Mutex
+	files map[string]bool
+	dirs  map[string]bool
+	roots map[string]bool
+	// watched maps each directory of the added files, as watchman
+	// names it, to the name it was added by. They differ if the path
+	// goes through a symlink. known holds the latter.
+	watched map[string]string
+	known   map[string]bool
+	// poll watches the files once the connection is lost.
+	poll       *pollingMonitor
+	forwarding sync.WaitGroup
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewWatchmanMonitor returns a FileMonitor that uses the watchman
+// daemon listening on socket. If socket is empty, it's found by running
+// `watchman get-sockname`, which starts the daemon if need be.
+func NewWatchmanMonitor(fileChangeDelay time.Duration, socket string) (FileMonitor, error) {
+	if socket == "" {
+		var err error
+		if socket, err = watchmanSockname(); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to watchman: %v", err)
+	}
+
+	f := watchmanMonitor{
+		conn:    conn,
+		replies: make(chan map[string]interface{}),
+		files:   make(map[string]bool),
+		dirs:    make(map[string]bool),
+		roots:   make(map[string]bool),
+		watched: make(map[string]string),
+		known:   make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+	f.fileChangeDelay = fileChangeDelay
+	f.changes = make(chan string)
+
+	go f.serveListeners()
+	go f.read()
+
+	if _, err := f.command("version"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &f, nil
+}
+
+func watchmanSockname() (string, error) {
+	out, err := exec.Command("watchman", "--no-pretty", "get-sockname").Output()
+	if err != nil {
+		return "", fmt.Errorf("couldn't find the watchman socket; is watchman installed? %v", err)
+	}
+	var reply struct {
+		Sockname string
+		Error    string
+	}
+	if err := json.Unmarshal(out, &reply); err != nil {
+		return "", fmt.Errorf("couldn't find the watchman socket: %v", err)
+	}
+	if reply.Error != "" {
+		return "", fmt.Errorf("couldn't find the watchman socket: %s", reply.Error)
+	}
+	return reply.Sockname, nil
+}
+
+// Add watches file, watching and subscribing to its project first if
+// need be.
+func (f *watchmanMonitor) Add(file string) error {
+	if f.ignored(file) {
+		return nil
+	}
+	f.digests.remember(file)
+
+	dir := filepath.Dir(file)
+	if info, err := os.Stat(file); err == nil && info.IsDir() {
+		dir = file
+	}
+
+	f.mu.Lock()
+	if dir == file {
+		f.dirs[file] = true
+	} else {
+		f.files[file] = true
+	}
+	known := f.known[dir]
+	poll := f.poll
+	f.mu.Unlock()
+	if poll != nil {
+		return poll.Add(file)
+	}
+	if known {
+		return nil
+	}
+	if err := f.watch(dir); err != nil {
+		// The command may have failed because the connection was lost.
+		f.mu.Lock()
+		poll = f.poll
+		f.mu.Unlock()
+		if poll != nil {
+			return poll.Add(file)
+		}
+		return err
+	}
+	return nil
+}
+
+// watch watches the project dir is in, subscribing to it if it's new.
+func (f *watchmanMonitor) watch(dir string) error {
+	reply, err := f.command("watch-project", dir)
+	if err != nil {
+		return err
+	}
+	root, _ := reply["watch"].(string)
+	if root == "" {
+		return fmt.Errorf("watchman didn't say where it's watching %s", dir)
+	}
+	name := root
+	if rel, _ := reply["relative_path"].(string); rel != "" {
+		name = filepath.Join(root, filepath.FromSlash(rel))
+	}
+
+	f.mu.Lock()
+	f.watched[name] = dir
+	f.known[dir] = true
+	subscribed := f.roots[root]
+	f.roots[root] = true
+	f.mu.Unlock()
+	if subscribed {
+		return nil
+	}
+
+	// Only report changes from now on: the files being added were
+	// loaded just now.
+	reply, err = f.command("clock", root)
+	if err != nil {
+		return f.unwatchRoot(root, err)
+	}
+	_, err = f.command("subscribe", root, watchmanSubscription, map[string]interface{}{
+		"expression":              []interface{}{"type", "f"},
+		"fields":                  []string{"name", "exists"},
+		"since":                   reply["clock"],
+		"empty_on_fresh_instance": true,
+	})
+	if err != nil {
+		return f.unwatchRoot(root, err)
+	}
+	return nil
+}
+
+// unwatchRoot forgets that root is subscribed to, so that the next Add
+// in it tries again.
+func (f *watchmanMonitor) unwatchRoot(root string, err error) error {
+	f.mu.Lock()
+	delete(f.roots, root)
+	f.mu.Unlock()
+	return err
+}
+
+func (f *watchmanMonitor) Close() error {
+	var err error
+	f.stopOnce.Do(func() {
+		close(f.stop)
+		err = f.conn.Close()
+		f.mu.Lock()
+		if f.poll != nil {
+			f.poll.Close()
+		}
+		f.mu.Unlock()
+	})
+	return err
+}
+
+// fallBack polls the files and directories added so far, and any added
+// later, once the connection to watchman is lost.
+func (f *watchmanMonitor) fallBack(err error) {
+	f.mu.Lock()
+	select {
+	case <-f.stop:
+		f.mu.Unlock()
+		return
+	default:
+	}
+	f.poll = newPollingMonitor(0, DefaultPollInterval, false)
+	f.setDegraded(fmt.Sprintf("lost the connection to watchman (%v), so files are polled every %v instead", err, DefaultPollInterval))
+	var added []string
+	for file := range f.dirs {
+		added = append(added, file)
+	}
+	for file := range f.files {
+		added = append(added, file)
+	}
+	poll := f.poll
+	changes := poll.Listen()
+	f.forwarding.Add(1)
+	f.mu.Unlock()
+
+	go func() {
+		defer f.forwarding.Done()
+		for files := range changes {
+			for _, file := range files {
+				f.changes <- file
+			}
+		}
+	}()
+	for _, file := range added {
+		poll.Add(file)
+	}
+	slog.Error(fmt.Errorf("lost the connection to watchman; polling %d files instead: %v", len(added), err))
+}
+
+// command sends a command to watchman, and returns its reply.
+func (f *watchmanMonitor) command(args ...interface{}) (map[string]interface{}, error) {
+	f.requestL.Lock()
+	defer f.requestL.Unlock()
+
+	data, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(watchmanTimeout))
+	if _, err := f.conn.Write(append(data, '\n')); err != nil {
+		return nil, fmt.Errorf("watchman %s: %v", args[0], err)
+	}
+
+	select {
+	case reply, ok := <-f.replies:
+		if !ok {
+			return nil, fmt.Errorf("watchman %s: the connection to watchman was closed", args[0])
+		}
+		if msg, ok := reply["error"].(string); ok {
+			return nil, fmt.Errorf("watchman %s: %s", args[0], msg)
+		}
+		return reply, nil
+	case <-time.After(watchmanTimeout):
+		// Its reply could be taken for the next command's, so give up
+		// on the connection.
+		f.conn.Close()
+		return nil, fmt.Errorf("watchman %s: timed out", args[0])
+	case <-f.stop:
+		return nil, errors.New("the watchman monitor is closed")
+	}
+}
+
+// read reads everything watchman sends, passing replies to commands to
+// command, and handling subscription updates itself.
+func (f *watchmanMonitor) read() {
+	defer func() {
+		// Polling may have taken over from watchman.
+		<-f.stop
+		f.forwarding.Wait()
+		close(f.changes)
+	}()
+	defer close(f.replies)
+
+	scanner := bufio.NewScanner(f.conn)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var pdu map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &pdu); err != nil {
+			slog.Trace("watchman: couldn't decode %q: %v", scanner.Text(), err)
+			continue
+		}
+
+		if unilateral, _ := pdu["unilateral"].(bool); !unilateral && pdu["subscription"] == nil && pdu["log"] == nil {
+			select {
+			case f.replies <- pdu:
+			case <-f.stop:
+				return
+			}
+			continue
+		}
+		if pdu["subscription"] != watchmanSubscription {
+			continue
+		}
+		for _, file := range f.changedFiles(pdu) {
+			select {
+			case f.changes <- file:
+			case <-f.stop:
+				return
+			}
+		}
+	}
+
+	err := scanner.Err()
+	if err == nil {
+		err = errors.New("watchman hung up")
+	}
+	f.fallBack(err)
+}
+
+// changedFiles returns the files in a subscription update that were
+// added, or created in a directory that was.
+func (f *watchmanMonitor) changedFiles(pdu map[string]interface{}) []string {
+	root, _ := pdu["root"].(string)
+	entries, _ := pdu["files"].([]interface{})
+	if root == "" || len(entries) == 0 {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var changed []string
+	for _, entry := range entries {
+		var name string
+		switch entry := entry.(type) {
+		case string:
+			name = entry
+		case map[string]interface{}:
+			name, _ = entry["name"].(string)
+		}
+		if name == "" || strings.HasPrefix(name, "/") {
+			continue
+		}
+		file := filepath.Join(root, filepath.FromSlash(name))
+		dir, ok := f.watched[filepath.Dir(file)]
+		if !ok {
+			continue
+		}
+		file = filepath.Join(dir, filepath.Base(file))
+		if f.files[file] || f.dirs[dir] {
+			changed = append(changed, file)
+		}
+	}
+	return changed
+}
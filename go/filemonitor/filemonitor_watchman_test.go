@@ -0,0 +1,249 @@
+package filemonitor_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+// fakeWatchman speaks enough of watchman's JSON protocol to watch one
+// project, rooted at root.
+type fakeWatchman struct {
+	t    *testing.T
+	root string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	commands [][]interface{}
+}
+
+func startFakeWatchman(t *testing.T, root string) (*fakeWatchman, string) {
+	sock := filepath.Join(t.TempDir(), "watchman.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	w := &fakeWatchman{t: t, root: root}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		w.mu.Lock()
+		w.conn = conn
+		w.mu.Unlock()
+		w.serve(conn)
+	}()
+	return w, sock
+}
+
+func (w *fakeWatchman) serve(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var command []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &command); err != nil {
+			w.t.Errorf("invalid command %q: %v", scanner.Text(), err)
+			return
+		}
+		w.mu.Lock()
+		w.commands = append(w.commands, command)
+		w.mu.Unlock()
+
+		switch command[0] {
+		case "version":
+			w.send(map[string]interface{}{"version": "2024.01.01.00"})
+		case "watch-project":
+			dir := command[1].(string)
+			rel, err := filepath.Rel(w.root, dir)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				w.send(map[string]interface{}{"error": "unable to resolve root " + dir})
+			} else if rel == "." {
+				w.send(map[string]interface{}{"watch": w.root})
+			} else {
+				w.send(map[string]interface{}{"watch": w.root, "relative_path": rel})
+			}
+		case "clock":
+			w.send(map[string]interface{}{"clock": "c:123:4"})
+		case "subscribe":
+			w.send(map[string]interface{}{"subscribe": command[2], "clock": "c:123:4"})
+		default:
+			w.send(map[string]interface{}{"error": "unknown command"})
+		}
+	}
+}
+
+func (w *fakeWatchman) send(pdu interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data, _ := json.Marshal(pdu)
+	w.conn.Write(append(data, '\n'))
+}
+
+// notify sends a subscription update for files, relative to the root.
+func (w *fakeWatchman) notify(names ...string) {
+	files := make([]interface{}, len(names))
+	for i, name := range names {
+		files[i] = map[string]interface{}{"name": name, "exists": true}
+	}
+	w.send(map[string]interface{}{
+		"subscription": "zeus", "root": w.root, "clock": "c:123:5", "unilateral": true, "files": files,
+	})
+}
+
+// hangUp drops the connection, as if watchman had died.
+func (w *fakeWatchman) hangUp() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.Close()
+}
+
+func (w *fakeWatchman) commandsNamed(name string) [][]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var commands [][]interface{}
+	for _, command := range w.commands {
+		if command[0] == name {
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
+
+func TestWatchmanMonitor(t *testing.T) {
+	files, err := writeTestFiles(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Dir(files[0])
+	sub := filepath.Join(root, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	w, sock := startFakeWatchman(t, root)
+
+	fm, err := filemonitor.New(filemonitor.Options{
+		Backend:         filemonitor.BackendWatchman,
+		FileChangeDelay: 10 * time.Millisecond,
+		WatchmanSocket:  sock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	for _, file := range append(files, sub) {
+		if err := fm.Add(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fm.Add("/elsewhere/file.rb"); err == nil {
+		t.Error("expected watchman's error to be returned")
+	}
+
+	// One subscription for the project, from the clock when it was
+	// first watched.
+	subscriptions := w.commandsNamed("subscribe")
+	if len(subscriptions) != 1 {
+		t.Fatalf("expected one subscription, got %v", subscriptions)
+	}
+	query := subscriptions[0][3].(map[string]interface{})
+	if subscriptions[0][1] != root || query["since"] != "c:123:4" {
+		t.Errorf("unexpected subscription %v", subscriptions[0])
+	}
+	if projects := w.commandsNamed("watch-project"); len(projects) != 3 {
+		t.Errorf("expected each directory to be watched once, got %v", projects)
+	}
+
+	changes := fm.Listen()
+	if err := ioutil.WriteFile(files[0], []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.notify("file0", "unwatched.rb", "sub/new.rb", "sub/deeper/new.rb")
+	if err := expectChanges(changes, []string{files[0], filepath.Join(sub, "new.rb")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchmanMonitorFallsBackToPolling(t *testing.T) {
+	files, err := writeTestFiles(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, sock := startFakeWatchman(t, filepath.Dir(files[0]))
+	fm, err := filemonitor.NewWatchmanMonitor(10*time.Millisecond, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fm.Close()
+	if err := fm.Add(files[0]); err != nil {
+		t.Fatal(err)
+	}
+	changes := fm.Listen()
+
+	w.hangUp()
+	deadline := time.Now().Add(time.Second)
+	for fm.Degraded() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if degraded := fm.Degraded(); !strings.Contains(degraded, "polled") {
+		t.Fatalf("expected the monitor to say files are polled, got %q", degraded)
+	}
+	// Files added before and after the connection was lost are polled.
+	if err := fm.Add(files[1]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	for _, file := range files {
+		if err := ioutil.WriteFile(file, []byte("changed"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	timeout := time.After(3 * filemonitor.DefaultPollInterval)
+	for len(seen) < len(files) {
+		select {
+		case changed, ok := <-changes:
+			if !ok {
+				t.Fatal("expected the monitor to keep running")
+			}
+			for _, file := range changed {
+				seen[file] = true
+			}
+		case <-timeout:
+			t.Fatalf("expected changes to %v, got %v", files, seen)
+		}
+	}
+}
+
+func TestWatchmanMonitorClose(t *testing.T) {
+	w, sock := startFakeWatchman(t, t.TempDir())
+	fm, err := filemonitor.NewWatchmanMonitor(filemonitor.DefaultFileChangeDelay, sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := fm.Listen()
+	fm.Close()
+
+	if _, ok := <-changes; ok {
+		t.Fatal("expected closing the monitor to close its listeners")
+	}
+	if versions := w.commandsNamed("version"); !reflect.DeepEqual(versions, [][]interface{}{{"version"}}) {
+		t.Errorf("expected the connection to be checked, got %v", versions)
+	}
+
+	if _, err := filemonitor.NewWatchmanMonitor(filemonitor.DefaultFileChangeDelay, filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Error("expected an error without watchman")
+	}
+}
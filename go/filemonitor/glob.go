@@ -0,0 +1,106 @@
+package filemonitor
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Glob is an absolute path pattern, in which "**" matches any number
+// of directories and other segments are matched with path.Match. A
+// pattern without wildcards that names a directory matches everything
+// beneath it.
+type Glob string
+
+// CheckGlob returns an error if pattern isn't a valid Glob.
+func CheckGlob(pattern string) error {
+	if strings.TrimSpace(pattern) == "" {
+		return fmt.Errorf("%q matches nothing", pattern)
+	}
+	for _, segment := range strings.Split(filepath.ToSlash(pattern), "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("%q is not a valid pattern", pattern)
+		}
+	}
+	return nil
+}
+
+// Match reports whether file, an absolute path, matches the glob.
+func (g Glob) Match(file string) bool {
+	pattern := filepath.Clean(string(g))
+	if !hasMeta(pattern) {
+		return file == pattern || strings.HasPrefix(file, pattern+string(filepath.Separator))
+	}
+	return matchSegments(splitPath(pattern), splitPath(filepath.Clean(file)))
+}
+
+// Expand returns the files the glob matches, and the directories to
+// watch for new ones: those the glob could match files in. A pattern
+// without wildcards is returned as a file if it isn't a directory, with
+// its directory in case it doesn't exist yet. Paths that ignore matches
+// are skipped, as are directories beneath them.
+func (g Glob) Expand(ignore *Ignore) (files, dirs []string) {
+	pattern := filepath.Clean(string(g))
+	base, depth := pattern, -1
+	if hasMeta(pattern) {
+		base = globBase(pattern)
+		if !strings.Contains(pattern, "**") {
+			depth = len(splitPath(pattern)) - len(splitPath(base))
+		}
+	}
+
+	info, err := os.Stat(base)
+	if err != nil || !info.IsDir() {
+		if base != pattern || ignore.Match(base) {
+			return nil, nil
+		}
+		if dir := filepath.Dir(base); isDir(dir, "") && !ignore.Match(dir) {
+			dirs = append(dirs, dir)
+		}
+		return []string{base}, dirs
+	}
+
+	baseDepth := len(splitPath(base))
+	filepath.Walk(base, func(file string, info os.FileInfo, err error) error {
+		if err != nil || ignore.Match(file) {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			// Without "**", directories deeper than the pattern can't
+			// hold matches.
+			if depth >= 0 && len(splitPath(file))-baseDepth >= depth {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, file)
+		} else if g.Match(file) {
+			files = append(files, file)
+		}
+		return nil
+	})
+	return files, dirs
+}
+
+// globBase returns the directory above the first segment of pattern
+// with wildcards in it.
+func globBase(pattern string) string {
+	segments := strings.Split(pattern, string(filepath.Separator))
+	for i, segment := range segments {
+		if hasMeta(segment) {
+			return filepath.Join(string(filepath.Separator), filepath.Join(segments[:i]...))
+		}
+	}
+	return pattern
+}
+
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+func splitPath(file string) []string {
+	return strings.Split(strings.Trim(filepath.ToSlash(file), "/"), "/")
+}
@@ -0,0 +1,77 @@
+package filemonitor_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		glob, file string
+		expected   bool
+	}{
+		{"/app/.env", "/app/.env", true},
+		{"/app/.env", "/app/.env.local", false},
+		{"/app/config/locales", "/app/config/locales/fr/fr.yml", true},
+		{"/app/config/*.yml", "/app/config/database.yml", true},
+		{"/app/config/*.yml", "/app/config/locales/en.yml", false},
+		{"/app/config/**/*.yml", "/app/config/database.yml", true},
+		{"/app/config/**/*.yml", "/app/config/locales/fr/fr.yml", true},
+		{"/app/config/**/*.yml", "/app/config/locales/fr/fr.rb", false},
+	}
+	for _, c := range cases {
+		if got := filemonitor.Glob(c.glob).Match(c.file); got != c.expected {
+			t.Errorf("%s against %s: expected %v, got %v", c.file, c.glob, c.expected, got)
+		}
+	}
+
+	if err := filemonitor.CheckGlob("config/[a-"); err == nil {
+		t.Error("expected an invalid pattern to be rejected")
+	}
+}
+
+func TestGlobExpand(t *testing.T) {
+	root := t.TempDir()
+	for _, file := range []string{"config/database.yml", "config/locales/en.yml", "config/locales/fr/fr.yml", "log/test.yml"} {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ignore, err := filemonitor.NewIgnore(root, []string{"fr/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := func(files ...string) []string {
+		for i := range files {
+			files[i] = filepath.Join(root, files[i])
+		}
+		return files
+	}
+
+	cases := []struct {
+		glob        string
+		files, dirs []string
+	}{
+		{"config/*.yml", abs("config/database.yml"), abs("config")},
+		{"config/**/*.yml", abs("config/database.yml", "config/locales/en.yml"), abs("config", "config/locales")},
+		{"config/locales", abs("config/locales/en.yml"), abs("config/locales")},
+		// Watched in case it's created.
+		{".env", abs(".env"), abs("")},
+		{"log/test.yml", abs("log/test.yml"), abs("log")},
+		{"tmp/*.txt", nil, nil},
+	}
+	for _, c := range cases {
+		files, dirs := filemonitor.Glob(filepath.Join(root, c.glob)).Expand(ignore)
+		if !reflect.DeepEqual(files, c.files) || !reflect.DeepEqual(dirs, c.dirs) {
+			t.Errorf("%s: expected %q and %q, got %q and %q", c.glob, c.files, c.dirs, files, dirs)
+		}
+	}
+}
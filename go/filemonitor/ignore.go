@@ -0,0 +1,210 @@
+package filemonitor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Ignore holds rules for files the monitor should neither watch nor
+// report changes to, such as editor swap files and logs. Rules are
+// .gitignore patterns, relative to a root directory:
+//
+//   - A pattern without a slash, like "*.swp", matches a file or
+//     directory of that name anywhere, including outside the root,
+//     unless it came from a .gitignore: as with git, those only apply
+//     inside the root.
+//   - A pattern with a slash, like "tmp/cache" or "/vendor", matches
+//     paths from the root.
+//   - A trailing slash, like "log/", matches only directories, and so
+//     everything beneath them.
+//   - "**" matches any number of directories, and a leading "!"
+//     re-includes paths an earlier rule ignored.
+//
+// As with git, a file can't be re-included if a directory above it is
+// ignored.
+type Ignore struct {
+	root  string
+	rules []ignoreRule
+}
+
+type ignoreRule struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	// gitignore is set for rules from a .gitignore file.
+	gitignore bool
+}
+
+// NewIgnore returns rules relative to root, which should be absolute.
+func NewIgnore(root string, patterns []string) (*Ignore, error) {
+	ig := &Ignore{root: filepath.Clean(root)}
+	for _, pattern := range patterns {
+		if err := ig.add(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return ig, nil
+}
+
+// AddGitignore adds the patterns in a .gitignore file, after the rules
+// already added. It's not an error if the file doesn't exist, and, as
+// with git, invalid patterns in it are skipped.
+func (ig *Ignore) AddGitignore(file string) error {
+	r, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if rule, _ := parseIgnoreRule(scanner.Text()); rule != nil {
+			rule.gitignore = true
+			ig.rules = append(ig.rules, *rule)
+		}
+	}
+	return scanner.Err()
+}
+
+// CheckIgnorePattern returns an error if pattern isn't a valid ignore
+// rule.
+func CheckIgnorePattern(pattern string) error {
+	_, err := parseIgnoreRule(pattern)
+	return err
+}
+
+func (ig *Ignore) add(pattern string) error {
+	rule, err := parseIgnoreRule(pattern)
+	if err != nil {
+		return err
+	}
+	if rule != nil {
+		ig.rules = append(ig.rules, *rule)
+	}
+	return nil
+}
+
+// parseIgnoreRule parses a line of a .gitignore, returning nil for blank
+// lines and comments.
+func parseIgnoreRule(pattern string) (*ignoreRule, error) {
+	pattern = strings.TrimRight(pattern, "\r")
+	if !strings.HasSuffix(pattern, `\ `) {
+		pattern = strings.TrimRight(pattern, " ")
+	}
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil, nil
+	}
+
+	original := pattern
+	var rule ignoreRule
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		rule.anchored = true
+		pattern = strings.TrimLeft(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, fmt.Errorf("%q matches nothing", original)
+	}
+
+	rule.segments = strings.Split(pattern, "/")
+	for _, segment := range rule.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("%q is not a valid pattern", original)
+		}
+	}
+	if !rule.anchored {
+		rule.segments = append([]string{"**"}, rule.segments...)
+	}
+	return &rule, nil
+}
+
+// Match reports whether file is ignored. Relative paths are taken to be
+// relative to the root.
+func (ig *Ignore) Match(file string) bool {
+	if ig == nil || len(ig.rules) == 0 {
+		return false
+	}
+
+	inRoot := true
+	if filepath.IsAbs(file) {
+		rel, err := filepath.Rel(ig.root, file)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			file = rel
+		} else {
+			inRoot = false
+		}
+	}
+	segments := strings.Split(strings.Trim(filepath.ToSlash(filepath.Clean(file)), "/"), "/")
+
+	// Check each directory above the file first, as nothing beneath an
+	// ignored directory can be re-included.
+	for i := 1; i < len(segments); i++ {
+		if ig.matchSegments(segments[:i], true, inRoot) {
+			return true
+		}
+	}
+	return ig.matchSegments(segments, isDir(file, ig.root), inRoot)
+}
+
+func (ig *Ignore) matchSegments(segments []string, dir, inRoot bool) bool {
+	ignored := false
+	for _, rule := range ig.rules {
+		if rule.negate != ignored {
+			continue // can't change the outcome
+		}
+		if rule.dirOnly && !dir || (rule.anchored || rule.gitignore) && !inRoot {
+			continue
+		}
+		if matchSegments(rule.segments, segments) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// matchSegments matches a path against a pattern, one directory at a
+// time, where "**" matches any number of directories.
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+func isDir(file, root string) bool {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(root, file)
+	}
+	info, err := os.Stat(file)
+	return err == nil && info.IsDir()
+}
@@ -0,0 +1,118 @@
+package filemonitor_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "app", "log"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	gitignore := filepath.Join(root, ".gitignore")
+	contents := "# Generated\n/public/assets\n*.log\n!keep.log\nbuild/\n\n[\n"
+	if err := ioutil.WriteFile(gitignore, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ignore, err := filemonitor.NewIgnore(root, []string{"*.swp", "log/", "tmp/cache", "config/**/*.local.yml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ignore.AddGitignore(gitignore); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"app/models/user.rb":              false,
+		"app/models/.user.rb.swp":         true,
+		"/usr/lib/ruby/.foo.rb.swp":       true,
+		"app/log/production.rb":           true,
+		"log":                             false, // not a directory
+		"tmp/cache/bootsnap":              true,
+		"lib/tmp/cache":                   false,
+		"config/database.local.yml":       true,
+		"config/env/staging.local.yml":    true,
+		"public/assets/app.js":            true,
+		"/elsewhere/public/assets/app.js": false,
+		"test.log":                        true,
+		"keep.log":                        false,
+		"app/log/keep.log":                true, // its directory is ignored
+		"build/app.js":                    true,
+		// A .gitignore only applies in its repository.
+		"/gems/foo/build/foo.so": false,
+		"/usr/lib/ruby/test.log": false,
+	}
+	for file, expected := range cases {
+		if !filepath.IsAbs(file) && file != "log" {
+			file = filepath.Join(root, file)
+		}
+		if got := ignore.Match(file); got != expected {
+			t.Errorf("%s: expected %v, got %v", file, expected, got)
+		}
+	}
+
+	var none *filemonitor.Ignore
+	if none.Match(filepath.Join(root, "test.log")) {
+		t.Error("expected no rules to match nothing")
+	}
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	for _, pattern := range []string{"[", "/", "foo/[a-"} {
+		if err := filemonitor.CheckIgnorePattern(pattern); err == nil {
+			t.Errorf("%q: expected an error", pattern)
+		}
+	}
+	for _, pattern := range []string{"", "# comment", "!*.rb", "**/tmp/", `\#notes`} {
+		if err := filemonitor.CheckIgnorePattern(pattern); err != nil {
+			t.Errorf("%q: %v", pattern, err)
+		}
+	}
+}
+
+func TestMonitorSkipsIgnoredFiles(t *testing.T) {
+	files, err := writeTestFiles(t.TempDir(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Dir(files[0])
+
+	fm := filemonitor.NewPollingMonitor(10*time.Millisecond, testPollInterval, false)
+	defer fm.Close()
+
+	ignore, err := filemonitor.NewIgnore(root, []string{"file0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.SetIgnore(ignore)
+	for _, file := range files {
+		if err := fm.Add(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes := fm.Listen()
+
+	// file1 is watched already, but changes to it are dropped once it's
+	// ignored.
+	if ignore, err = filemonitor.NewIgnore(root, []string{"file0", "file1"}); err != nil {
+		t.Fatal(err)
+	}
+	fm.SetIgnore(ignore)
+
+	later := time.Now().Add(time.Minute)
+	for _, file := range files {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := expectChanges(changes, files[2:]); err != nil {
+		t.Fatal(err)
+	}
+}
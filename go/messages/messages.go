@@ -2,13 +2,18 @@ package messages
 
 import (
 	"errors"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+func CreatePidMessage(pid, parentPid int, identifier string) string {
+	return "P:" + strconv.Itoa(pid) + ":" + strconv.Itoa(parentPid) + ":" + identifier
+}
+
 func ParsePidMessage(msg string) (int, int, string, error) {
 	parts := strings.SplitN(msg, ":", 4)
-	if parts[0] != "P" {
+	if len(parts) != 4 || parts[0] != "P" {
 		return -1, -1, "", errors.New("Wrong message type! Expected PidMessage, got: " + msg)
 	}
 
@@ -32,31 +37,107 @@ func CreateCommandAndArgumentsMessage(args []string, pid int) string {
 
 func ParseFeatureMessage(msg string) (string, error) {
 	parts := strings.SplitN(msg, ":", 2)
-	if parts[0] != "F" {
+	if len(parts) != 2 || parts[0] != "F" {
 		return "", errors.New("Wrong message type! Expected FeatureMessage, got: " + msg)
 	}
 	return strings.TrimSpace(parts[1]), nil
 }
 
+func CreateActionResponseMessage(result string) string {
+	return "R:" + result
+}
+
 func ParseActionResponseMessage(msg string) (string, error) {
 	parts := strings.SplitN(msg, ":", 2)
-	if parts[0] != "R" {
+	if len(parts) != 2 || parts[0] != "R" {
 		return "", errors.New("Wrong message type! Expected ActionResponseMessage, got: " + msg)
 	}
 	return parts[1], nil
 }
 
-func CreateSpawnSlaveMessage(identifier string) string {
-	return "S:" + identifier
+func CreateSpawnSlaveMessage(identifier string, env map[string]string) string {
+	return "S:" + identifier + encodeEnv(env)
+}
+
+func CreateSpawnCommandMessage(identifier string, env map[string]string) string {
+	return "C:" + identifier + encodeEnv(env)
+}
+
+// ParseSpawnMessage splits a Spawn Slave or Spawn Command message into
+// its code ("S" or "C"), identifier, and environment variables.
+func ParseSpawnMessage(msg string) (string, string, map[string]string, error) {
+	lines := strings.Split(msg, "\n")
+	parts := strings.SplitN(lines[0], ":", 2)
+	if len(parts) != 2 || (parts[0] != "S" && parts[0] != "C") {
+		return "", "", nil, errors.New("Wrong message type! Expected SpawnMessage, got: " + msg)
+	}
+
+	env, err := decodeEnv(lines[1:])
+	if err != nil {
+		return "", "", nil, err
+	}
+	return parts[0], parts[1], env, nil
+}
+
+var (
+	envEscaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	envUnescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n")
+)
+
+// encodeEnv formats environment variables to follow the identifier in
+// a spawn message: one KEY=VALUE per line, in order, with backslashes
+// and newlines in values escaped.
+func encodeEnv(env map[string]string) string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString("\n" + key + "=" + envEscaper.Replace(env[key]))
+	}
+	return b.String()
+}
+
+func decodeEnv(lines []string) (map[string]string, error) {
+	var env map[string]string
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("Malformed environment variable: " + line)
+		}
+		if env == nil {
+			env = make(map[string]string)
+		}
+		env[kv[0]] = envUnescaper.Replace(kv[1])
+	}
+	return env, nil
+}
+
+// CreateClientEnvironmentMessage describes the client's working
+// directory and environment variables, which the master passes on to
+// the command. It follows the ClientCommandRequestMessage.
+func CreateClientEnvironmentMessage(cwd string, env map[string]string) string {
+	return "E:" + envEscaper.Replace(cwd) + encodeEnv(env)
 }
 
-func CreateSpawnCommandMessage(identifier string) string {
-	return "C:" + identifier
+func ParseClientEnvironmentMessage(msg string) (string, map[string]string, error) {
+	lines := strings.Split(msg, "\n")
+	if !strings.HasPrefix(lines[0], "E:") {
+		return "", nil, errors.New("Wrong message type! Expected ClientEnvironmentMessage, got: " + msg)
+	}
+	env, err := decodeEnv(lines[1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return envUnescaper.Replace(lines[0][2:]), env, nil
 }
 
 func ParseClientCommandRequestMessage(msg string) (int, int, string, error) {
 	parts := strings.SplitN(msg, ":", 4)
-	if parts[0] != "T" {
+	if len(parts) != 4 || parts[0] != "T" {
 		return -1, -1, "", errors.New("Wrong message type! Expected ClientCommandRequestMessage, got: " + msg)
 	}
 
@@ -72,6 +153,62 @@ func ParseClientCommandRequestMessage(msg string) (int, int, string, error) {
 	return argLength, pid, parts[3], nil
 }
 
-func CreatePidAndArgumentsMessage(pid int, argCount int) string {
-	return strconv.Itoa(pid) + ":" + strconv.Itoa(argCount)
+// CreatePidAndArgumentsMessage tells the command the client's pid and
+// how many arguments to expect, followed by the directory and
+// environment variables to run with.
+func CreatePidAndArgumentsMessage(pid int, argCount int, cwd string, env map[string]string) string {
+	return strconv.Itoa(pid) + ":" + strconv.Itoa(argCount) + "\n" + envEscaper.Replace(cwd) + encodeEnv(env)
+}
+
+func ParsePidAndArgumentsMessage(msg string) (int, int, string, map[string]string, error) {
+	lines := strings.Split(msg, "\n")
+	parts := strings.SplitN(lines[0], ":", 2)
+	if len(parts) != 2 {
+		return -1, -1, "", nil, errors.New("Wrong message type! Expected PidAndArgumentsMessage, got: " + msg)
+	}
+
+	pid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return -1, -1, "", nil, errors.New("Expected pid, but none received: " + msg)
+	}
+	argCount, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return -1, -1, "", nil, errors.New("Expected argument count, but none received: " + msg)
+	}
+
+	var cwd string
+	var env map[string]string
+	if len(lines) > 1 {
+		cwd = envUnescaper.Replace(lines[1])
+		env, err = decodeEnv(lines[2:])
+		if err != nil {
+			return -1, -1, "", nil, err
+		}
+	}
+	return pid, argCount, cwd, env, nil
+}
+
+// Control messages are sent by a client to the master in place of a
+// ClientCommandRequestMessage to query or drive the master itself.
+const (
+	ControlStatus  = "status"
+	ControlWait    = "wait"
+	ControlRestart = "restart"
+	ControlStop    = "stop"
+)
+
+func CreateControlMessage(op string, args ...string) string {
+	return strings.Join(append([]string{"X", op}, args...), ":")
+}
+
+func IsControlMessage(msg string) bool {
+	return strings.HasPrefix(msg, "X:")
+}
+
+func ParseControlMessage(msg string) (string, []string, error) {
+	parts := strings.Split(msg, ":")
+	if parts[0] != "X" || len(parts) < 2 || parts[1] == "" {
+		return "", nil, errors.New("Wrong message type! Expected ControlMessage, got: " + msg)
+	}
+	return parts[1], parts[2:], nil
 }
@@ -1,6 +1,7 @@
 package messages_test
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/burke/zeus/go/messages"
@@ -14,15 +15,79 @@ func TestCreateCommandAndArgumentsMessage(t *testing.T) {
 }
 
 func TestCreateSpawnSlaveMessage(t *testing.T) {
-	message := messages.CreateSpawnSlaveMessage("decimate")
+	message := messages.CreateSpawnSlaveMessage("decimate", nil)
 	if message != "S:decimate" {
 		t.Fatal(message)
 	}
 }
 
 func TestCreateSpawnCommandMessage(t *testing.T) {
-	message := messages.CreateSpawnCommandMessage("decimate")
+	message := messages.CreateSpawnCommandMessage("decimate", nil)
 	if message != "C:decimate" {
 		t.Fatal(message)
 	}
 }
+
+func TestSpawnMessageEnv(t *testing.T) {
+	env := map[string]string{
+		"RAILS_ENV":    "test",
+		"DATABASE_URL": "postgres://localhost/test?a=b",
+		"MULTILINE":    "one\ntwo\\n",
+	}
+	message := messages.CreateSpawnSlaveMessage("test_environment", env)
+	expected := "S:test_environment\nDATABASE_URL=postgres://localhost/test?a=b\nMULTILINE=one\\ntwo\\\\n\nRAILS_ENV=test"
+	if message != expected {
+		t.Fatalf("expected %q, got %q", expected, message)
+	}
+
+	code, identifier, parsed, err := messages.ParseSpawnMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "S" || identifier != "test_environment" || !reflect.DeepEqual(parsed, env) {
+		t.Fatalf("unexpected %q %q %v", code, identifier, parsed)
+	}
+}
+
+func TestClientEnvironmentMessage(t *testing.T) {
+	env := map[string]string{"SEED": "1234", "COVERAGE": "1"}
+	message := messages.CreateClientEnvironmentMessage("/app/spec/models", env)
+	if message != "E:/app/spec/models\nCOVERAGE=1\nSEED=1234" {
+		t.Fatal(message)
+	}
+
+	cwd, parsed, err := messages.ParseClientEnvironmentMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cwd != "/app/spec/models" || !reflect.DeepEqual(parsed, env) {
+		t.Fatalf("unexpected %q %v", cwd, parsed)
+	}
+}
+
+func TestCreatePidAndArgumentsMessage(t *testing.T) {
+	message := messages.CreatePidAndArgumentsMessage(100, 2, "/app/spec", map[string]string{"SEED": "1234"})
+	if message != "100:2\n/app/spec\nSEED=1234" {
+		t.Fatal(message)
+	}
+}
+
+func TestControlMessage(t *testing.T) {
+	message := messages.CreateControlMessage("restart", "test_environment")
+	if message != "X:restart:test_environment" {
+		t.Fatal(message)
+	}
+	if !messages.IsControlMessage(message) {
+		t.Fatal("expected a control message")
+	}
+	op, args, err := messages.ParseControlMessage(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != "restart" || len(args) != 1 || args[0] != "test_environment" {
+		t.Fatal(op, args)
+	}
+	if _, _, err := messages.ParseControlMessage("X:"); err == nil {
+		t.Fatal("expected an error for an empty control message")
+	}
+}
@@ -0,0 +1,311 @@
+package messages
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version 1 of the protocol is the original one: strings with a
+// one-letter type prefix and colon-delimited fields. Version 2 sends each
+// message as a JSON object whose "type" names the message, so fields can
+// be added without breaking peers that don't know them. In both, each
+// message is one NUL-terminated packet on the socket; JSON never
+// contains a raw NUL.
+const (
+	LegacyVersion   = 1
+	ProtocolVersion = 2
+)
+
+// A Message is one of the typed messages described in
+// docs/message_format.md.
+type Message interface {
+	// Type names the message in its JSON encoding.
+	Type() string
+}
+
+// Hello opens version negotiation. The side that connects sends the
+// newest version it speaks; the other side answers with the version
+// both will use. Hello is always sent as JSON.
+type Hello struct {
+	Version int `json:"version"`
+}
+
+// Pid identifies a slave or command process to the master.
+type Pid struct {
+	Pid        int    `json:"pid"`
+	ParentPid  int    `json:"parent_pid"`
+	Identifier string `json:"identifier"`
+}
+
+// ActionResponse reports the result of a slave's action: "OK", or a
+// description of the error.
+type ActionResponse struct {
+	Result string `json:"result"`
+}
+
+// SpawnSlave asks a slave to fork the named child slave.
+type SpawnSlave struct {
+	Identifier string            `json:"identifier"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+// SpawnCommand asks a slave to fork the named command.
+type SpawnCommand struct {
+	Identifier string            `json:"identifier"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+// CommandRequest asks the master to run a command for a client.
+type CommandRequest struct {
+	Command  string `json:"command"`
+	ArgCount int    `json:"arg_count"`
+	Pid      int    `json:"pid"`
+}
+
+// ClientEnvironment carries the client's working directory and
+// environment variables.
+type ClientEnvironment struct {
+	Cwd string            `json:"cwd"`
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// Control asks the master to report on or act on itself.
+type Control struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args,omitempty"`
+}
+
+// PidAndArguments tells a command the client's pid, how many arguments
+// to expect, and the directory and environment to run with.
+type PidAndArguments struct {
+	Pid      int               `json:"pid"`
+	ArgCount int               `json:"arg_count"`
+	Cwd      string            `json:"cwd"`
+	Env      map[string]string `json:"env,omitempty"`
+}
+
+// CommandPid tells the client the pid of its command, or 0 if the
+// command couldn't be started.
+type CommandPid struct {
+	Pid int `json:"pid"`
+}
+
+// ExitStatus reports the exit code of a command.
+type ExitStatus struct {
+	Code int `json:"code"`
+}
+
+func (*Hello) Type() string             { return "hello" }
+func (*Pid) Type() string               { return "pid" }
+func (*ActionResponse) Type() string    { return "action_response" }
+func (*SpawnSlave) Type() string        { return "spawn_slave" }
+func (*SpawnCommand) Type() string      { return "spawn_command" }
+func (*CommandRequest) Type() string    { return "command_request" }
+func (*ClientEnvironment) Type() string { return "client_environment" }
+func (*Control) Type() string           { return "control" }
+func (*PidAndArguments) Type() string   { return "pid_and_arguments" }
+func (*CommandPid) Type() string        { return "command_pid" }
+func (*ExitStatus) Type() string        { return "exit_status" }
+
+// A Codec encodes and decodes messages in one version of the protocol.
+// Decode fills in msg, which must be a pointer to the type of message
+// expected, and fails if data holds a message of any other type.
+type Codec interface {
+	Version() int
+	Encode(msg Message) (string, error)
+	Decode(data string, msg Message) error
+}
+
+var (
+	Legacy Codec = legacyCodec{}
+	JSON   Codec = jsonCodec{}
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// CodecForVersion returns the codec for a negotiated protocol version.
+func CodecForVersion(version int) (Codec, error) {
+	switch version {
+	case LegacyVersion:
+		return Legacy, nil
+	case ProtocolVersion:
+		return JSON, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+}
+
+// A Conn sends and receives whole messages, as a unixsocket.Usock does.
+type Conn interface {
+	ReadMessage() (string, error)
+	WriteMessage(msg string) (int, error)
+}
+
+func Send(conn Conn, codec Codec, msg Message) error {
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteMessage(data)
+	return err
+}
+
+func Receive(conn Conn, codec Codec, msg Message) error {
+	data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return codec.Decode(data, msg)
+}
+
+// Accept reads the first message a peer sends. A peer that negotiates
+// opens with a Hello, which Accept answers before reading the peer's
+// next message. Any other first message comes from a peer that predates
+// negotiation and speaks version 1. Either way, Accept returns the codec
+// to use and the peer's first message, still encoded.
+func Accept(conn Conn) (Codec, string, error) {
+	data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var hello Hello
+	if JSON.Decode(data, &hello) != nil {
+		return Legacy, data, nil
+	}
+
+	version := hello.Version
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	codec, err := CodecForVersion(version)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := Send(conn, JSON, &Hello{Version: version}); err != nil {
+		return nil, "", err
+	}
+
+	data, err = conn.ReadMessage()
+	return codec, data, err
+}
+
+// Connect negotiates from the connecting side, returning the codec for
+// the version the peer chose.
+func Connect(conn Conn) (Codec, error) {
+	if err := Send(conn, JSON, &Hello{Version: ProtocolVersion}); err != nil {
+		return nil, err
+	}
+	var hello Hello
+	if err := Receive(conn, JSON, &hello); err != nil {
+		return nil, err
+	}
+	return CodecForVersion(hello.Version)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Version() int { return ProtocolVersion }
+
+// Encode writes the message's fields after its type, so the type is
+// the first thing a reader sees.
+func (jsonCodec) Encode(msg Message) (string, error) {
+	fields, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	typ, _ := json.Marshal(msg.Type())
+
+	data := `{"type":` + string(typ)
+	if len(fields) > 2 {
+		data += "," + string(fields[1:])
+	} else {
+		data += "}"
+	}
+	return data, nil
+}
+
+func (jsonCodec) Decode(data string, msg Message) error {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal([]byte(data), &header); err != nil {
+		return wrongType(msg, data)
+	}
+	if header.Type != msg.Type() {
+		return wrongType(msg, data)
+	}
+	return json.Unmarshal([]byte(data), msg)
+}
+
+type legacyCodec struct{}
+
+func (legacyCodec) Version() int { return LegacyVersion }
+
+func (legacyCodec) Encode(msg Message) (string, error) {
+	switch m := msg.(type) {
+	case *Pid:
+		return CreatePidMessage(m.Pid, m.ParentPid, m.Identifier), nil
+	case *ActionResponse:
+		return CreateActionResponseMessage(m.Result), nil
+	case *SpawnSlave:
+		return CreateSpawnSlaveMessage(m.Identifier, m.Env), nil
+	case *SpawnCommand:
+		return CreateSpawnCommandMessage(m.Identifier, m.Env), nil
+	case *CommandRequest:
+		return "T:" + strconv.Itoa(m.ArgCount) + ":" + strconv.Itoa(m.Pid) + ":" + m.Command, nil
+	case *ClientEnvironment:
+		return CreateClientEnvironmentMessage(m.Cwd, m.Env), nil
+	case *Control:
+		return CreateControlMessage(m.Op, m.Args...), nil
+	case *PidAndArguments:
+		return CreatePidAndArgumentsMessage(m.Pid, m.ArgCount, m.Cwd, m.Env), nil
+	case *CommandPid:
+		return strconv.Itoa(m.Pid), nil
+	case *ExitStatus:
+		return strconv.Itoa(m.Code), nil
+	}
+	return "", fmt.Errorf("%s messages can't be sent in protocol version %d", msg.Type(), LegacyVersion)
+}
+
+func (legacyCodec) Decode(data string, msg Message) (err error) {
+	switch m := msg.(type) {
+	case *Pid:
+		m.Pid, m.ParentPid, m.Identifier, err = ParsePidMessage(data)
+	case *ActionResponse:
+		m.Result, err = ParseActionResponseMessage(data)
+	case *SpawnSlave:
+		var code string
+		code, m.Identifier, m.Env, err = ParseSpawnMessage(data)
+		if err == nil && code != "S" {
+			err = wrongType(msg, data)
+		}
+	case *SpawnCommand:
+		var code string
+		code, m.Identifier, m.Env, err = ParseSpawnMessage(data)
+		if err == nil && code != "C" {
+			err = wrongType(msg, data)
+		}
+	case *CommandRequest:
+		m.ArgCount, m.Pid, m.Command, err = ParseClientCommandRequestMessage(data)
+	case *ClientEnvironment:
+		m.Cwd, m.Env, err = ParseClientEnvironmentMessage(data)
+	case *Control:
+		m.Op, m.Args, err = ParseControlMessage(data)
+	case *PidAndArguments:
+		m.Pid, m.ArgCount, m.Cwd, m.Env, err = ParsePidAndArgumentsMessage(data)
+	case *CommandPid:
+		m.Pid, err = strconv.Atoi(strings.TrimSpace(data))
+	case *ExitStatus:
+		m.Code, err = strconv.Atoi(strings.TrimSpace(data))
+	default:
+		err = fmt.Errorf("%s messages can't be received in protocol version %d", msg.Type(), LegacyVersion)
+	}
+	return err
+}
+
+func wrongType(msg Message, data string) error {
+	return fmt.Errorf("Wrong message type! Expected %s message, got: %s", msg.Type(), data)
+}
@@ -0,0 +1,173 @@
+package messages_test
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/burke/zeus/go/messages"
+)
+
+var typedMessages = []messages.Message{
+	&messages.Pid{Pid: 1235, ParentPid: 1234, Identifier: "default_bundle"},
+	&messages.ActionResponse{Result: "-e:1:in '<main>': unhandled exception"},
+	&messages.SpawnSlave{Identifier: "test_environment", Env: map[string]string{"RAILS_ENV": "test"}},
+	&messages.SpawnCommand{Identifier: "console"},
+	&messages.CommandRequest{Command: "rspec", ArgCount: 2, Pid: 4321},
+	&messages.ClientEnvironment{Cwd: "/app/spec", Env: map[string]string{"SEED": "1234"}},
+	&messages.Control{Op: messages.ControlRestart, Args: []string{"test_environment"}},
+	&messages.PidAndArguments{Pid: 4321, ArgCount: 2, Cwd: "/app/spec", Env: map[string]string{"SEED": "1234"}},
+	&messages.CommandPid{Pid: 1236},
+	&messages.ExitStatus{Code: 1},
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for _, codec := range []messages.Codec{messages.Legacy, messages.JSON} {
+		for _, msg := range typedMessages {
+			data, err := codec.Encode(msg)
+			if err != nil {
+				t.Errorf("v%d %s: %v", codec.Version(), msg.Type(), err)
+				continue
+			}
+
+			decoded := reflect.New(reflect.TypeOf(msg).Elem()).Interface().(messages.Message)
+			if err := codec.Decode(data, decoded); err != nil {
+				t.Errorf("v%d %s: %v", codec.Version(), msg.Type(), err)
+			} else if !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("v%d %s: expected %+v, got %+v", codec.Version(), msg.Type(), msg, decoded)
+			}
+		}
+	}
+}
+
+func TestJSONEncoding(t *testing.T) {
+	data, err := messages.JSON.Encode(&messages.Pid{Pid: 1235, ParentPid: 1234, Identifier: "boot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"type":"pid","pid":1235,"parent_pid":1234,"identifier":"boot"}`; data != expected {
+		t.Fatalf("expected %s, got %s", expected, data)
+	}
+
+	// Fields the receiver doesn't know about are ignored.
+	var response messages.ActionResponse
+	if err := messages.JSON.Decode(`{"type":"action_response","result":"OK","took_ms":12}`, &response); err != nil || response.Result != "OK" {
+		t.Fatalf("unexpected %+v, %v", response, err)
+	}
+}
+
+func TestDecodeRejectsMalformedMessages(t *testing.T) {
+	cases := []struct {
+		codec messages.Codec
+		data  string
+		msg   messages.Message
+	}{
+		{messages.Legacy, "P", &messages.Pid{}},
+		{messages.Legacy, "P:1235", &messages.Pid{}},
+		{messages.Legacy, "P:one:two:boot", &messages.Pid{}},
+		{messages.Legacy, "R", &messages.ActionResponse{}},
+		{messages.Legacy, "C:console", &messages.SpawnSlave{}},
+		{messages.Legacy, "S:boot\nNOVALUE", &messages.SpawnSlave{}},
+		{messages.Legacy, "T:1:100", &messages.CommandRequest{}},
+		{messages.Legacy, "", &messages.CommandRequest{}},
+		{messages.Legacy, "X:", &messages.Control{}},
+		{messages.Legacy, "100", &messages.PidAndArguments{}},
+		{messages.Legacy, "", &messages.ExitStatus{}},
+		{messages.Legacy, "{}", &messages.Hello{}},
+		{messages.JSON, "P:1235:0:boot", &messages.Pid{}},
+		{messages.JSON, `{"type":"exit_status","code":1}`, &messages.Pid{}},
+		{messages.JSON, `{"type":"pid","pid":"1235"}`, &messages.Pid{}},
+		{messages.JSON, `{"type":"pid"`, &messages.Pid{}},
+	}
+	for _, c := range cases {
+		if err := c.codec.Decode(c.data, c.msg); err == nil {
+			t.Errorf("v%d: expected %q not to decode as a %s message", c.codec.Version(), c.data, c.msg.Type())
+		}
+	}
+}
+
+// pipeConn is one end of an in-memory connection.
+type pipeConn struct {
+	in  <-chan string
+	out chan<- string
+}
+
+func newPipe() (*pipeConn, *pipeConn) {
+	a, b := make(chan string, 8), make(chan string, 8)
+	return &pipeConn{a, b}, &pipeConn{b, a}
+}
+
+func (c *pipeConn) ReadMessage() (string, error) {
+	msg, ok := <-c.in
+	if !ok {
+		return "", io.EOF
+	}
+	return msg, nil
+}
+
+func (c *pipeConn) WriteMessage(msg string) (int, error) {
+	c.out <- msg
+	return len(msg), nil
+}
+
+func TestNegotiation(t *testing.T) {
+	master, slave := newPipe()
+
+	go func() {
+		codec, err := messages.Connect(slave)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		messages.Send(slave, codec, &messages.Pid{Pid: 1235, Identifier: "boot"})
+	}()
+
+	codec, msg, err := messages.Accept(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.Version() != messages.ProtocolVersion {
+		t.Fatalf("expected version %d, got %d", messages.ProtocolVersion, codec.Version())
+	}
+	var pid messages.Pid
+	if err := codec.Decode(msg, &pid); err != nil || pid.Pid != 1235 || pid.Identifier != "boot" {
+		t.Fatalf("unexpected %+v, %v", pid, err)
+	}
+}
+
+func TestNegotiationWithNewerPeer(t *testing.T) {
+	master, slave := newPipe()
+	slave.WriteMessage(`{"type":"hello","version":7}`)
+	slave.WriteMessage(`{"type":"pid","pid":1235,"identifier":"boot"}`)
+
+	codec, _, err := messages.Accept(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.Version() != messages.ProtocolVersion {
+		t.Fatalf("expected version %d, got %d", messages.ProtocolVersion, codec.Version())
+	}
+	if reply, _ := slave.ReadMessage(); reply != `{"type":"hello","version":2}` {
+		t.Fatalf("unexpected reply %s", reply)
+	}
+
+	master, slave = newPipe()
+	slave.WriteMessage(`{"type":"hello","version":0}`)
+	if _, _, err := messages.Accept(master); !errors.Is(err, messages.ErrUnsupportedVersion) {
+		t.Fatalf("expected an unsupported version error, got %v", err)
+	}
+}
+
+func TestAcceptLegacyPeer(t *testing.T) {
+	master, slave := newPipe()
+	slave.WriteMessage("P:1235:0:boot")
+
+	codec, msg, err := messages.Accept(master)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec != messages.Legacy || msg != "P:1235:0:boot" {
+		t.Fatalf("expected the legacy codec and the pid message, got v%d and %q", codec.Version(), msg)
+	}
+}
@@ -0,0 +1,125 @@
+package processtree
+
+import (
+	"sync/atomic"
+	"time"
+
+	slog "github.com/burke/zeus/go/shinylog"
+)
+
+type EventKind int
+
+const (
+	// EventStateChanged reports a node moving from OldState to State.
+	EventStateChanged EventKind = iota
+	// EventPlanChanged reports that the config file was reloaded, and
+	// nodes or commands may have been added or removed.
+	EventPlanChanged
+	// EventFileMonitorDegraded reports that the file monitor started
+	// watching files less well than it should, such as polling them
+	// because inotify ran out of watches. Error explains how.
+	EventFileMonitorDegraded
+)
+
+// An Event reports a change in the tree to its subscribers.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	// The rest describe the node, for EventStateChanged. OldState and
+	// State are one of SUnbooted, SBooting, SReady, and SCrashed; Pid
+	// and Error are as of entering State. Error is also set for
+	// EventFileMonitorDegraded.
+	Node     string
+	OldState string
+	State    string
+	Pid      int
+	Error    string
+
+	// Files lists the changed files that made the node restart, when
+	// it is entering SUnbooted because of them.
+	Files []string
+}
+
+// A Subscription receives the tree's events on C, in order, until it is
+// closed. Publishing never waits for subscribers: if C's buffer is
+// full, the event is dropped and counted instead.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	dropped int64
+	tree    *ProcessTree
+}
+
+const defaultSubscriptionBuffer = 256
+
+// Subscribe starts delivering events to a new subscription.
+func (tree *ProcessTree) Subscribe() *Subscription {
+	c := make(chan Event, defaultSubscriptionBuffer)
+	sub := &Subscription{C: c, c: c, tree: tree}
+
+	tree.subscribersL.Lock()
+	defer tree.subscribersL.Unlock()
+	if tree.subscribers == nil {
+		tree.subscribers = make(map[*Subscription]bool)
+	}
+	tree.subscribers[sub] = true
+	return sub
+}
+
+// Close stops delivering events. C is not closed, as a publisher may
+// still be sending on it.
+func (sub *Subscription) Close() {
+	sub.tree.subscribersL.Lock()
+	defer sub.tree.subscribersL.Unlock()
+	delete(sub.tree.subscribers, sub)
+}
+
+// Dropped returns how many events were dropped because C was full.
+func (sub *Subscription) Dropped() int {
+	return int(atomic.LoadInt64(&sub.dropped))
+}
+
+func (tree *ProcessTree) publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	tree.subscribersL.Lock()
+	defer tree.subscribersL.Unlock()
+	for sub := range tree.subscribers {
+		select {
+		case sub.c <- event:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// StateName returns the name of a state for humans: "ready" for SReady,
+// and so on.
+func StateName(state string) string {
+	return humanreadableStates[state]
+}
+
+// traceEvents writes every event to the trace log until quit is closed.
+func traceEvents(sub *Subscription, quit <-chan bool) {
+	defer sub.Close()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case event := <-sub.C:
+			switch event.Kind {
+			case EventPlanChanged:
+				slog.Trace("event: the plan changed")
+			case EventStateChanged:
+				slog.Trace("event: %s/(%d) %s -> %s, error %q, files %q", event.Node, event.Pid, StateName(event.OldState), StateName(event.State), event.Error, event.Files)
+			case EventFileMonitorDegraded:
+				slog.Trace("event: the file monitor is degraded: %s", event.Error)
+			}
+		}
+	}
+}
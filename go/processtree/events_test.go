@@ -0,0 +1,53 @@
+package processtree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSubscriptions(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	a, b := tree.Subscribe(), tree.Subscribe()
+	defer a.Close()
+
+	tree.publish(Event{Kind: EventStateChanged, Node: "boot", OldState: SUnbooted, State: SBooting})
+	for _, sub := range []*Subscription{a, b} {
+		event := <-sub.C
+		if event.Node != "boot" || event.State != SBooting || event.Time.IsZero() {
+			t.Errorf("unexpected event %+v", event)
+		}
+	}
+
+	// A closed subscription gets nothing more, and a full one doesn't
+	// hold up the others.
+	b.Close()
+	for i := 0; i < defaultSubscriptionBuffer+3; i++ {
+		tree.publish(Event{Kind: EventPlanChanged})
+	}
+	if len(b.C) != 0 {
+		t.Errorf("expected no events after closing, got %d", len(b.C))
+	}
+	if len(a.C) != defaultSubscriptionBuffer || a.Dropped() != 3 {
+		t.Errorf("expected a full buffer and 3 dropped events, got %d and %d", len(a.C), a.Dropped())
+	}
+}
+
+func TestRestartForChangedFiles(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": "", "default_bundle": "boot", "test_environment": "default_bundle"}, nil)
+	bundle := tree.SlavesByName["default_bundle"]
+	bundle.features["/app/Gemfile.lock"] = true
+	bundle.features["/app/config/application.rb"] = true
+
+	tree.RestartNodesWithFeatures([]string{"/app/README.md", "/app/Gemfile.lock", "/app/config/application.rb"})
+
+	expected := []string{"/app/Gemfile.lock", "/app/config/application.rb"}
+	if reason := bundle.pendingRestart; reason == nil || reason.Node != "default_bundle" || !reflect.DeepEqual(reason.Files, expected) {
+		t.Errorf("expected the restart to record %q, got %+v", expected, reason)
+	}
+	if len(bundle.needsRestart) != 1 {
+		t.Error("expected default_bundle to restart")
+	}
+	if boot := tree.SlavesByName["boot"]; len(boot.needsRestart) != 0 || boot.pendingRestart != nil {
+		t.Error("expected boot not to restart")
+	}
+}
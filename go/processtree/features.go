@@ -0,0 +1,88 @@
+package processtree
+
+// Files are owned by the node that loaded them first. Nodes inherit the
+// files their ancestors loaded, and restarting a node restarts its
+// descendants, so only one node in a line of descent needs to own a
+// file: a node reporting a file that an ancestor or descendant already
+// owns is ignored, and a change to the file restarts just the owner.
+// Nodes in different branches can own the same file.
+
+// addFeature records that the node loaded file, returning whether it
+// became one of the file's owners.
+func (s *SlaveNode) addFeature(file string) bool {
+	tree := s.tree
+	tree.L.RLock()
+	defer tree.L.RUnlock()
+	tree.featuresL.Lock()
+	defer tree.featuresL.Unlock()
+
+	for _, owner := range tree.featureOwners[file] {
+		if owner == s || owner.isAncestorOf(s) || s.isAncestorOf(owner) {
+			return false
+		}
+	}
+	if tree.featureOwners == nil {
+		tree.featureOwners = make(map[string][]*SlaveNode)
+	}
+	tree.featureOwners[file] = append(tree.featureOwners[file], s)
+
+	s.featureL.Lock()
+	s.features[file] = true
+	s.featureL.Unlock()
+	return true
+}
+
+// releaseFeatures gives up the node's files, when it leaves the plan or
+// restarts.
+func (s *SlaveNode) releaseFeatures() {
+	tree := s.tree
+	tree.featuresL.Lock()
+	defer tree.featuresL.Unlock()
+
+	s.featureL.Lock()
+	defer s.featureL.Unlock()
+	for file := range s.features {
+		owners := tree.featureOwners[file][:0]
+		for _, owner := range tree.featureOwners[file] {
+			if owner != s {
+				owners = append(owners, owner)
+			}
+		}
+		if len(owners) == 0 {
+			delete(tree.featureOwners, file)
+		} else {
+			tree.featureOwners[file] = owners
+		}
+	}
+	s.features = make(map[string]bool)
+}
+
+// releaseSubtreeFeatures gives up the files of the node and all its
+// descendants, as they are about to boot again. Each then claims the
+// files it loads afresh, ancestors first, so a file the node has only
+// now started to load is no longer owned by the descendant that loaded
+// it before.
+func (s *SlaveNode) releaseSubtreeFeatures() {
+	s.tree.L.RLock()
+	defer s.tree.L.RUnlock()
+
+	var release func(node *SlaveNode)
+	release = func(node *SlaveNode) {
+		node.releaseFeatures()
+		for _, slave := range node.Slaves {
+			release(slave)
+		}
+	}
+	release(s)
+}
+
+// isAncestorOf reports whether s is above node in the tree. The tree's
+// lock must be held.
+func (s *SlaveNode) isAncestorOf(node *SlaveNode) bool {
+	for p := node.Parent; p != nil; p = p.Parent {
+		if p == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package processtree
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func featureTree() *ProcessTree {
+	return buildTree(map[string]string{
+		"boot":             "",
+		"default_bundle":   "boot",
+		"test_environment": "default_bundle",
+		"test_helper":      "test_environment",
+		"development":      "default_bundle",
+	}, nil)
+}
+
+// restarted returns the nodes that have a restart queued, sorted.
+func restarted(tree *ProcessTree) []string {
+	var names []string
+	for name, node := range tree.SlavesByName {
+		if len(node.needsRestart) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFeatureOwnership(t *testing.T) {
+	tree := featureTree()
+	nodes := tree.SlavesByName
+
+	if !nodes["test_helper"].addFeature("/app/spec/support/helpers.rb") {
+		t.Error("expected the first node to load a file to own it")
+	}
+	if nodes["default_bundle"].addFeature("/app/spec/support/helpers.rb") {
+		t.Error("expected an ancestor not to take over a file")
+	}
+	nodes["default_bundle"].addFeature("/app/Gemfile.lock")
+	if nodes["test_helper"].addFeature("/app/Gemfile.lock") {
+		t.Error("expected a descendant not to take over a file")
+	}
+	if !nodes["development"].addFeature("/app/spec/support/helpers.rb") {
+		t.Error("expected nodes in different branches to share a file")
+	}
+
+	if features := nodes["default_bundle"].Features(); !reflect.DeepEqual(features, []string{"/app/Gemfile.lock"}) {
+		t.Errorf("unexpected features %q", features)
+	}
+}
+
+func TestMinimalRestarts(t *testing.T) {
+	cases := []struct {
+		changed  string
+		expected []string
+	}{
+		// Only the node that loaded the file first, even though its
+		// ancestor reported it later.
+		{"/app/spec/spec_helper.rb", []string{"test_helper"}},
+		{"/app/config/environments/test.rb", []string{"test_environment"}},
+		// Restarting default_bundle takes care of its descendants.
+		{"/app/Gemfile.lock", []string{"default_bundle"}},
+		// Both branches loaded it.
+		{"/app/lib/shared.rb", []string{"development", "test_helper"}},
+		{"/app/README.md", nil},
+	}
+	for _, c := range cases {
+		tree := featureTree()
+		nodes := tree.SlavesByName
+		nodes["test_helper"].addFeature("/app/spec/spec_helper.rb")
+		nodes["default_bundle"].addFeature("/app/spec/spec_helper.rb")
+		nodes["test_environment"].addFeature("/app/config/environments/test.rb")
+		nodes["default_bundle"].addFeature("/app/Gemfile.lock")
+		nodes["test_helper"].addFeature("/app/Gemfile.lock")
+		nodes["test_helper"].addFeature("/app/lib/shared.rb")
+		nodes["development"].addFeature("/app/lib/shared.rb")
+
+		tree.RestartNodesWithFeatures([]string{c.changed})
+		if actual := restarted(tree); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: expected %q to restart, got %q", c.changed, c.expected, actual)
+		}
+	}
+}
+
+func TestReleaseFeatures(t *testing.T) {
+	tree := featureTree()
+	nodes := tree.SlavesByName
+	nodes["test_helper"].addFeature("/app/spec/spec_helper.rb")
+
+	nodes["test_helper"].releaseFeatures()
+	if len(nodes["test_helper"].Features()) != 0 {
+		t.Error("expected a removed node to own no files")
+	}
+	if !nodes["test_environment"].addFeature("/app/spec/spec_helper.rb") {
+		t.Error("expected a released file to be free to own")
+	}
+}
+
+func TestRestartReleasesSubtreeFeatures(t *testing.T) {
+	tree := featureTree()
+	nodes := tree.SlavesByName
+	nodes["test_helper"].addFeature("/app/test/helpers.rb")
+	nodes["boot"].addFeature("/app/Gemfile")
+
+	// default_bundle starts requiring helpers.rb too. When it reboots it
+	// loads it before test_helper does, and so takes it over.
+	nodes["default_bundle"].doRestart()
+	if !nodes["default_bundle"].addFeature("/app/test/helpers.rb") {
+		t.Fatal("expected the restarted node to own the file")
+	}
+	if nodes["test_helper"].addFeature("/app/test/helpers.rb") {
+		t.Error("expected the descendant to leave the file to its ancestor")
+	}
+	if len(nodes["boot"].Features()) != 1 {
+		t.Error("expected nodes above the restarted one to keep their files")
+	}
+
+	for _, node := range nodes {
+		select {
+		case <-node.needsRestart:
+		default:
+		}
+	}
+	tree.RestartNodesWithFeatures([]string{"/app/test/helpers.rb"})
+	if actual := restarted(tree); !reflect.DeepEqual(actual, []string{"default_bundle"}) {
+		t.Errorf("expected default_bundle to restart, got %q", actual)
+	}
+}
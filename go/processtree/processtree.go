@@ -1,15 +1,49 @@
 package processtree
 
 import (
+	"path"
 	"sync"
+	"time"
+
+	"github.com/burke/zeus/go/filemonitor"
 )
 
 type ProcessTree struct {
+	// L guards the shape of the tree, which changes when the config
+	// file is reloaded: Root, ExecCommand, SlavesByName, Commands, and
+	// the Slaves and Commands of each node, and the settings below.
+	L sync.RWMutex
+
 	Root         *SlaveNode
 	ExecCommand  string
 	SlavesByName map[string]*SlaveNode
 	Commands     []*CommandNode
-	StateChanged chan bool
+
+	// CommandTimeout bounds how long a client waits for a command to
+	// boot. Zero means no limit.
+	CommandTimeout time.Duration
+
+	// ClientEnv lists the environment variables passed from clients to
+	// the commands they run, as path.Match patterns.
+	ClientEnv []string
+
+	// WatchIgnore holds the rules for files the file monitor skips.
+	WatchIgnore *filemonitor.Ignore
+
+	// monitorDegraded is what the file monitor last said about
+	// watching files less well than it should; see watch.go.
+	monitorL        sync.Mutex
+	monitorDegraded string
+
+	subscribersL sync.Mutex
+	subscribers  map[*Subscription]bool
+
+	// featureOwners lists the nodes that own each loaded file; see
+	// features.go.
+	featuresL     sync.Mutex
+	featureOwners map[string][]*SlaveNode
+
+	slaveMonitor *SlaveMonitor
 }
 
 type ProcessTreeNode struct {
@@ -22,6 +56,9 @@ type CommandNode struct {
 	ProcessTreeNode
 	booting sync.RWMutex
 	Aliases []string
+
+	// Env is set in the command's process, on top of its node's.
+	Env map[string]string
 }
 
 func (tree *ProcessTree) NewCommandNode(name string, aliases []string, parent *SlaveNode) *CommandNode {
@@ -33,14 +70,51 @@ func (tree *ProcessTree) NewCommandNode(name string, aliases []string, parent *S
 	return x
 }
 
+// ClientEnvAllowed reports whether patterns, like ClientEnv, let the
+// environment variable key through from clients.
+func ClientEnvAllowed(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func (tree *ProcessTree) FindSlaveByName(name string) *SlaveNode {
+	tree.L.RLock()
+	defer tree.L.RUnlock()
+
 	if name == "" {
 		return tree.Root
 	}
 	return tree.SlavesByName[name]
 }
 
+// AllSlaves returns every node in the tree, in no particular order.
+func (tree *ProcessTree) AllSlaves() []*SlaveNode {
+	tree.L.RLock()
+	defer tree.L.RUnlock()
+
+	slaves := make([]*SlaveNode, 0, len(tree.SlavesByName))
+	for _, slave := range tree.SlavesByName {
+		slaves = append(slaves, slave)
+	}
+	return slaves
+}
+
+// AllCommands returns a copy of the list of commands.
+func (tree *ProcessTree) AllCommands() []*CommandNode {
+	tree.L.RLock()
+	defer tree.L.RUnlock()
+
+	return append([]*CommandNode(nil), tree.Commands...)
+}
+
 func (tree *ProcessTree) FindCommand(requested string) *CommandNode {
+	tree.L.RLock()
+	defer tree.L.RUnlock()
+
 	for _, command := range tree.Commands {
 		if command.Name == requested {
 			return command
@@ -55,6 +129,9 @@ func (tree *ProcessTree) FindCommand(requested string) *CommandNode {
 }
 
 func (tree *ProcessTree) AllCommandsAndAliases() []string {
+	tree.L.RLock()
+	defer tree.L.RUnlock()
+
 	var values []string
 	for _, command := range tree.Commands {
 		values = append(values, command.Name)
@@ -67,22 +144,30 @@ func (tree *ProcessTree) AllCommandsAndAliases() []string {
 
 var restartMutex sync.Mutex
 
+// RestartNodesWithFeatures restarts the nodes that own or watch any of
+// files, along with their descendants.
 func (tree *ProcessTree) RestartNodesWithFeatures(files []string) {
 	restartMutex.Lock()
 	defer restartMutex.Unlock()
+	tree.L.RLock()
+	defer tree.L.RUnlock()
 	tree.Root.trace("%d files changed, beginning with %q", len(files), files[0])
 	tree.Root.restartNodesWithFeatures(tree, files)
 }
 
 // Serialized: restartMutex is always held when this is called.
 func (node *SlaveNode) restartNodesWithFeatures(tree *ProcessTree, files []string) {
+	var changed []string
 	for _, file := range files {
-		if node.HasFeature(file) {
-			node.trace("restarting for %q", file)
-			node.RequestRestart()
-			return
+		if node.HasFeature(file) || node.watches(file) {
+			changed = append(changed, file)
 		}
 	}
+	if len(changed) > 0 {
+		node.trace("restarting for %q", changed)
+		node.requestRestartForFiles(changed)
+		return
+	}
 	for _, s := range node.Slaves {
 		s.restartNodesWithFeatures(tree, files)
 	}
@@ -0,0 +1,21 @@
+package processtree
+
+import "testing"
+
+func TestClientEnvAllowed(t *testing.T) {
+	patterns := []string{"SEED", "SPEC_*"}
+	cases := map[string]bool{
+		"SEED":         true,
+		"SPEC_OPTS":    true,
+		"SEEDS":        false,
+		"GITHUB_TOKEN": false,
+	}
+	for key, expected := range cases {
+		if actual := ClientEnvAllowed(patterns, key); actual != expected {
+			t.Errorf("%s: expected %v, got %v", key, expected, actual)
+		}
+	}
+	if ClientEnvAllowed(nil, "SEED") {
+		t.Error("expected nothing to be allowed without patterns")
+	}
+}
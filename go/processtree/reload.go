@@ -0,0 +1,95 @@
+package processtree
+
+// ApplyPlan reshapes the running tree to match newTree, which was built
+// from an updated config file. Nodes are matched by name: new nodes are
+// started, nodes that disappeared are killed, and nodes that moved to a
+// different parent are restarted. Everything else keeps running, picking
+// up its new settings the next time it boots.
+//
+// The root can't be swapped in place, so ApplyPlan returns false without
+// changing anything if the new plan has a different root; the caller
+// should rebuild the tree from scratch instead.
+func (tree *ProcessTree) ApplyPlan(newTree *ProcessTree) bool {
+	restartMutex.Lock()
+	defer restartMutex.Unlock()
+
+	tree.L.Lock()
+	if tree.Root == nil || newTree.Root == nil || tree.Root.Name != newTree.Root.Name {
+		tree.L.Unlock()
+		return false
+	}
+
+	var started, restarted, removed []*SlaveNode
+	if tree.ExecCommand != newTree.ExecCommand {
+		restarted = append(restarted, tree.Root)
+	}
+	tree.ExecCommand = newTree.ExecCommand
+	tree.CommandTimeout = newTree.CommandTimeout
+	tree.ClientEnv = newTree.ClientEnv
+	tree.WatchIgnore = newTree.WatchIgnore
+
+	live := make(map[string]*SlaveNode)
+	var adopt func(planned, parent *SlaveNode) *SlaveNode
+	adopt = func(planned, parent *SlaveNode) *SlaveNode {
+		node, ok := tree.SlavesByName[planned.Name]
+		if ok {
+			node.L.Lock()
+			node.BootTimeout = planned.BootTimeout
+			node.Retries = planned.Retries
+			node.RetryBackoff = planned.RetryBackoff
+			node.Env = planned.Env
+			node.L.Unlock()
+			node.Watch = planned.Watch
+			if node.Parent != parent {
+				node.trace("moved under %s; restarting", parent.Name)
+				node.Parent = parent
+				restarted = append(restarted, node)
+			}
+		} else {
+			node = planned
+			node.tree = tree
+			node.Parent = parent
+			started = append(started, node)
+		}
+		live[node.Name] = node
+
+		slaves := make([]*SlaveNode, 0, len(planned.Slaves))
+		for _, slave := range planned.Slaves {
+			slaves = append(slaves, adopt(slave, node))
+		}
+		node.Slaves = slaves
+
+		for _, command := range planned.Commands {
+			command.Parent = node
+		}
+		node.Commands = planned.Commands
+		return node
+	}
+	adopt(newTree.Root, nil)
+
+	for name, node := range tree.SlavesByName {
+		if live[name] == nil {
+			removed = append(removed, node)
+		}
+	}
+	tree.SlavesByName = live
+	tree.Commands = newTree.Commands
+	monitor := tree.slaveMonitor
+	tree.L.Unlock()
+
+	for _, node := range removed {
+		node.Remove()
+	}
+	// If the slave monitor hasn't started yet, it'll start the new nodes
+	// along with everything else.
+	if monitor != nil {
+		for _, node := range started {
+			go node.Run(monitor)
+		}
+	}
+	for _, node := range restarted {
+		node.RequestRestart()
+	}
+	tree.publish(Event{Kind: EventPlanChanged})
+	return true
+}
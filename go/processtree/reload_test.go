@@ -0,0 +1,114 @@
+package processtree
+
+import "testing"
+
+// buildTree builds a tree from a map of node names to parent names. The
+// node with no parent ("") is the root.
+func buildTree(parents map[string]string, commands map[string]string) *ProcessTree {
+	tree := &ProcessTree{}
+	tree.SlavesByName = make(map[string]*SlaveNode)
+
+	var build func(parent *SlaveNode, parentName string)
+	build = func(parent *SlaveNode, parentName string) {
+		for name, p := range parents {
+			if p != parentName {
+				continue
+			}
+			node := tree.NewSlaveNode(name, parent, nil)
+			if parent == nil {
+				tree.Root = node
+			} else {
+				parent.Slaves = append(parent.Slaves, node)
+			}
+			build(node, name)
+		}
+	}
+	build(nil, "")
+
+	for name, parent := range commands {
+		node := tree.SlavesByName[parent]
+		node.Commands = append(node.Commands, tree.NewCommandNode(name, nil, node))
+	}
+	return tree
+}
+
+func TestApplyPlan(t *testing.T) {
+	tree := buildTree(
+		map[string]string{"boot": "", "default_bundle": "boot", "development_environment": "default_bundle", "test_environment": "default_bundle"},
+		map[string]string{"console": "development_environment", "test": "test_environment"},
+	)
+	boot := tree.SlavesByName["boot"]
+	bundle := tree.SlavesByName["default_bundle"]
+	dev := tree.SlavesByName["development_environment"]
+	test := tree.SlavesByName["test_environment"]
+
+	newTree := buildTree(
+		map[string]string{"boot": "", "default_bundle": "boot", "development_environment": "default_bundle", "prerake": "default_bundle", "test_environment": "development_environment"},
+		map[string]string{"console": "development_environment", "rake": "prerake"},
+	)
+	newTree.SlavesByName["development_environment"].Retries = 3
+
+	if !tree.ApplyPlan(newTree) {
+		t.Fatal("expected the plan to be applied in place")
+	}
+
+	if tree.Root != boot || tree.SlavesByName["default_bundle"] != bundle || tree.SlavesByName["development_environment"] != dev {
+		t.Error("expected unchanged nodes to be kept")
+	}
+	if dev.Retries != 3 {
+		t.Errorf("expected settings to be updated, got %d retries", dev.Retries)
+	}
+	if tree.SlavesByName["test_environment"] != test || test.Parent != dev {
+		t.Error("expected test_environment to be moved under development_environment")
+	}
+
+	prerake := tree.SlavesByName["prerake"]
+	if prerake == nil || prerake.Parent != bundle || prerake.tree != tree {
+		t.Fatal("expected prerake to be added under default_bundle")
+	}
+	if len(bundle.Slaves) != 2 {
+		t.Errorf("expected default_bundle to have 2 slaves, got %d", len(bundle.Slaves))
+	}
+
+	if command := tree.FindCommand("rake"); command == nil || command.Parent != prerake {
+		t.Error("expected rake to run in prerake")
+	}
+	if command := tree.FindCommand("console"); command == nil || command.Parent != dev {
+		t.Error("expected console to run in the existing development_environment")
+	}
+	if tree.FindCommand("test") != nil {
+		t.Error("expected test to be removed")
+	}
+}
+
+func TestApplyPlanRemovesNodes(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": "", "default_bundle": "boot", "test_environment": "default_bundle"}, nil)
+	test := tree.SlavesByName["test_environment"]
+
+	newTree := buildTree(map[string]string{"boot": "", "default_bundle": "boot"}, nil)
+	if !tree.ApplyPlan(newTree) {
+		t.Fatal("expected the plan to be applied in place")
+	}
+
+	if tree.SlavesByName["test_environment"] != nil {
+		t.Error("expected test_environment to be removed from the tree")
+	}
+	if !test.removed {
+		t.Error("expected test_environment to be shut down")
+	}
+	if len(tree.Root.Slaves[0].Slaves) != 0 {
+		t.Error("expected default_bundle to have no slaves")
+	}
+}
+
+func TestApplyPlanNewRoot(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": "", "default_bundle": "boot"}, nil)
+	newTree := buildTree(map[string]string{"start": "", "default_bundle": "start"}, nil)
+
+	if tree.ApplyPlan(newTree) {
+		t.Error("expected a plan with a new root not to be applied in place")
+	}
+	if tree.Root.Name != "boot" {
+		t.Error("expected the tree to be unchanged")
+	}
+}
@@ -0,0 +1,53 @@
+package processtree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A RestartReason records why a node restarted. Node is where the
+// restart began: the node itself, or the ancestor it restarted along
+// with. Files lists the changed files Node had loaded, if that's why; if
+// it's empty, the restart was requested by a client or a config reload.
+type RestartReason struct {
+	Node  string    `json:"node"`
+	Files []string  `json:"files,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Describe explains to the user why node restarted, for example
+// "restarted for config/application.rb via default_bundle at 15:04:05".
+func (r *RestartReason) Describe(node string) string {
+	var why string
+	switch {
+	case len(r.Files) > 0:
+		why = "for " + relativePath(r.Files[0])
+		if len(r.Files) > 1 {
+			why += fmt.Sprintf(" and %d more", len(r.Files)-1)
+		}
+		if r.Node != node {
+			why += " via " + r.Node
+		}
+	case r.Node != node:
+		why = "with " + r.Node
+	default:
+		why = "on request"
+	}
+	return "restarted " + why + " at " + r.Time.Format("15:04:05")
+}
+
+// relativePath shortens paths in the project, which is the master's
+// working directory.
+func relativePath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
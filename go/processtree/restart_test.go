@@ -0,0 +1,30 @@
+package processtree
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDescribeRestart(t *testing.T) {
+	wd, _ := os.Getwd()
+	at := time.Date(2026, 1, 2, 15, 4, 5, 0, time.Local)
+	cases := []struct {
+		reason   RestartReason
+		node     string
+		expected string
+	}{
+		{RestartReason{Node: "default_bundle", Files: []string{filepath.Join(wd, "config", "application.rb")}, Time: at}, "default_bundle",
+			"restarted for config/application.rb at 15:04:05"},
+		{RestartReason{Node: "default_bundle", Files: []string{"/outside/foo.rb", "/outside/bar.rb"}, Time: at}, "test_helper",
+			"restarted for /outside/foo.rb and 1 more via default_bundle at 15:04:05"},
+		{RestartReason{Node: "test_environment", Time: at}, "test_environment", "restarted on request at 15:04:05"},
+		{RestartReason{Node: "test_environment", Time: at}, "test_helper", "restarted with test_environment at 15:04:05"},
+	}
+	for _, c := range cases {
+		if actual := c.reason.Describe(c.node); actual != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, actual)
+		}
+	}
+}
@@ -49,9 +49,16 @@ func StartSlaveMonitor(tree *ProcessTree, fileChanges <-chan []string, done chan
 			}
 		}()
 
-		for _, slave := range monitor.tree.SlavesByName {
+		if slog.TraceEnabled() {
+			go traceEvents(tree.Subscribe(), quit)
+		}
+
+		tree.L.Lock()
+		tree.slaveMonitor = monitor
+		for _, slave := range tree.SlavesByName {
 			go slave.Run(monitor)
 		}
+		tree.L.Unlock()
 
 		for {
 			select {
@@ -71,8 +78,11 @@ func StartSlaveMonitor(tree *ProcessTree, fileChanges <-chan []string, done chan
 }
 
 func (mon *SlaveMonitor) cleanupChildren() {
-	for _, slave := range mon.tree.SlavesByName {
-		slave.ForceKill()
+	for _, slave := range mon.tree.AllSlaves() {
+		slave.L.Lock()
+		pid := slave.pid
+		slave.L.Unlock()
+		slave.forceKillPid(pid)
 	}
 }
 
@@ -83,14 +93,23 @@ func (mon *SlaveMonitor) slaveDidBeginRegistration(fd int) {
 	slaveUsock, err := unixsocket.NewFromFile(slaveFile)
 	if err != nil {
 		slog.Error(err)
+		return
 	}
 
-	// We now expect the slave to use this fd they send us to send a Pid&Identifier Message
-	msg, err := slaveUsock.ReadMessage()
+	// We now expect the slave to use this fd they send us to send a
+	// Pid&Identifier Message, after negotiating a protocol version if
+	// it knows how.
+	codec, msg, err := messages.Accept(slaveUsock)
+	var pidMsg messages.Pid
+	if err == nil {
+		err = codec.Decode(msg, &pidMsg)
+	}
 	if err != nil {
 		slog.Error(err)
+		slaveUsock.Close()
+		return
 	}
-	pid, parentPid, identifier, err := messages.ParsePidMessage(msg)
+	pid, parentPid, identifier := pidMsg.Pid, pidMsg.ParentPid, pidMsg.Identifier
 
 	// And the last step before executing its action, the slave sends us a pipe it will later use to
 	// send us all the features it's loaded.
@@ -101,8 +120,19 @@ func (mon *SlaveMonitor) slaveDidBeginRegistration(fd int) {
 
 	slaveNode := mon.tree.FindSlaveByName(identifier)
 	if slaveNode == nil {
-		Error("slavemonitor.go:slaveDidBeginRegistration:Unknown identifier:" + identifier)
+		// The node may have been removed from the config while it was
+		// being spawned. Nothing will use the slave, so end it.
+		slog.ErrorString("A slave registered as " + strconv.Quote(identifier) + ", which is not a node in the plan; killing it")
+		slaveUsock.Close()
+		slaveFile.Close()
+		if err == nil {
+			syscall.Close(featurePipeFd)
+		}
+		if pid > 0 {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		return
 	}
 
-	slaveNode.SlaveWasInitialized(pid, parentPid, slaveUsock, featurePipeFd)
+	slaveNode.SlaveWasInitialized(pid, parentPid, slaveUsock, codec, featurePipeFd)
 }
@@ -0,0 +1,67 @@
+package processtree
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+func TestSlaveOfUnknownNodeIsKilled(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	mon := &SlaveMonitor{tree: tree}
+
+	slave := exec.Command("sleep", "30")
+	if err := slave.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer slave.Process.Kill()
+	exited := make(chan error, 1)
+	go func() { exited <- slave.Wait() }()
+
+	local, remote, err := unixsocket.Socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Dup(int(remote.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+	usock, err := unixsocket.NewFromFile(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer usock.Close()
+	featuresR, featuresW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer featuresW.Close()
+
+	// Register as a node that has since been removed from the plan.
+	go func() {
+		codec, err := messages.Connect(usock)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		messages.Send(usock, codec, &messages.Pid{Pid: slave.Process.Pid, ParentPid: os.Getpid(), Identifier: "removed"})
+		usock.WriteFD(int(featuresR.Fd()))
+		featuresR.Close()
+	}()
+	mon.slaveDidBeginRegistration(fd)
+
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("expected the slave to be killed")
+	}
+	if _, err := usock.ReadMessage(); err == nil {
+		t.Error("expected the slave's socket to be closed")
+	}
+}
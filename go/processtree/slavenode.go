@@ -2,9 +2,13 @@ package processtree
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,19 +31,52 @@ const (
 type SlaveNode struct {
 	ProcessTreeNode
 	socket      *unixsocket.Usock
+	codec       messages.Codec
 	pid         int
 	Error       string
 	Slaves      []*SlaveNode
 	Commands    []*CommandNode
 	fileMonitor filemonitor.FileMonitor
 
+	// BootTimeout bounds how long the node may take to boot before it
+	// is killed and marked crashed. Zero means no limit.
+	BootTimeout time.Duration
+	rootCmd     *exec.Cmd
+
+	// Env is set in the node's process before it runs its action, and
+	// so is inherited by the nodes and commands beneath it.
+	Env map[string]string
+
+	// Watch lists files the node depends on without loading them; see
+	// watch.go. It is guarded by the tree's lock.
+	Watch []filemonitor.Glob
+
+	tree    *ProcessTree
+	removed bool
+
+	// A node that crashes on its own (rather than because its parent
+	// did) is restarted up to Retries times, waiting RetryBackoff before
+	// the first attempt and twice as long before each one after that.
+	Retries        int
+	RetryBackoff   time.Duration
+	crashRetryable bool
+	attempt        int
+	nextRetry      time.Time
+	retry          <-chan time.Time
+
 	hasSuccessfullyBooted bool
 
+	// pendingRestart is why the node has been asked to restart, until
+	// it does; then it becomes lastRestart.
+	pendingRestart *RestartReason
+	lastRestart    *RestartReason
+
 	needsRestart        chan bool
 	commandBootRequests chan *CommandRequest
 	slaveBootRequests   chan *SlaveNode
 
-	L        sync.Mutex
+	L sync.Mutex
+	// features are the files the node owns, having loaded them first.
 	features map[string]bool
 	featureL sync.Mutex
 	state    string
@@ -50,11 +87,29 @@ type SlaveNode struct {
 type CommandReply struct {
 	State string
 	File  *os.File
+	// Codec is the protocol the command speaks, the same as its slave.
+	Codec messages.Codec
 }
 
+// A CommandRequest asks a slave to fork a command. The requester
+// cancels Context if it stops waiting (the client went away or its
+// deadline passed); cancelled requests are discarded when they reach the
+// front of the queue, and a command forked for one is shut down.
 type CommandRequest struct {
 	Name    string
+	Env     map[string]string
 	Retchan chan *CommandReply
+	Context context.Context
+}
+
+// reply hands the reply to the requester, unless it has stopped waiting.
+func (r *CommandRequest) reply(reply *CommandReply) bool {
+	select {
+	case r.Retchan <- reply:
+		return true
+	case <-r.Context.Done():
+		return false
+	}
 }
 
 const (
@@ -81,14 +136,44 @@ func (tree *ProcessTree) NewSlaveNode(identifier string, parent *SlaveNode, moni
 	s.Name = identifier
 	s.Parent = parent
 	s.fileMonitor = monitor
+	s.tree = tree
 	tree.SlavesByName[identifier] = &s
 	return &s
 }
 
+// Remove stops the node for good: its process is killed, and it stops
+// responding to requests. It is used when the node is no longer in the
+// plan.
+func (s *SlaveNode) Remove() {
+	s.L.Lock()
+	s.removed = true
+	pid := s.pid
+	s.L.Unlock()
+
+	// Knock the node out of whichever state it's waiting in.
+	s.RequestRestart()
+	s.forceKillPid(pid)
+}
+
 func (s *SlaveNode) RequestRestart() {
+	s.requestRestart(&RestartReason{Node: s.Name, Time: time.Now()})
+}
+
+// requestRestartForFiles restarts the node because files it loaded
+// changed.
+func (s *SlaveNode) requestRestartForFiles(files []string) {
+	s.requestRestart(&RestartReason{Node: s.Name, Files: files, Time: time.Now()})
+}
+
+func (s *SlaveNode) requestRestart(reason *RestartReason) {
 	s.L.Lock()
 	defer s.L.Unlock()
 
+	s.pendingRestart = reason
+
+	// Something changed, so the node gets a fresh set of retries.
+	s.attempt = 0
+
 	// If this slave is currently waiting on a process to boot,
 	// unhang it and force it to transition to the crashed state
 	// where it will wait for restart messages.
@@ -120,7 +205,7 @@ func (s *SlaveNode) ReportBootEvent() bool {
 	}
 }
 
-func (s *SlaveNode) SlaveWasInitialized(pid, parentPid int, usock *unixsocket.Usock, featurePipeFd int) {
+func (s *SlaveNode) SlaveWasInitialized(pid, parentPid int, usock *unixsocket.Usock, codec messages.Codec, featurePipeFd int) {
 	file := os.NewFile(uintptr(featurePipeFd), "featurepipe")
 
 	s.L.Lock()
@@ -131,8 +216,9 @@ func (s *SlaveNode) SlaveWasInitialized(pid, parentPid int, usock *unixsocket.Us
 		s.wipe()
 		s.pid = pid
 		s.socket = usock
+		s.codec = codec
 		go s.handleMessages(file)
-		s.trace("initialized slave %s with pid %d from parent %d", s.Name, pid, parentPid)
+		s.trace("initialized slave %s with pid %d from parent %d, speaking protocol version %d", s.Name, pid, parentPid, codec.Version())
 	}
 	s.L.Unlock()
 }
@@ -141,21 +227,34 @@ func (s *SlaveNode) Run(monitor *SlaveMonitor) {
 	nextState := SUnbooted
 	for {
 		s.L.Lock()
+		if s.removed {
+			s.L.Unlock()
+			s.doRemove()
+			return
+		}
+		event := Event{Kind: EventStateChanged, Node: s.Name, OldState: s.state, State: nextState}
 		s.state = nextState
+		if nextState == SCrashed {
+			s.scheduleRetry()
+		}
+		if nextState == SUnbooted && s.pendingRestart != nil {
+			s.lastRestart = s.pendingRestart
+			s.pendingRestart = nil
+			if s.lastRestart.Node == s.Name {
+				event.Files = s.lastRestart.Files
+			}
+		}
+		event.Pid, event.Error = s.pid, s.Error
 		s.L.Unlock()
-		monitor.tree.StateChanged <- true
+		monitor.tree.publish(event)
 		switch nextState {
 		case SUnbooted:
-			s.trace("entering state SUnbooted")
 			nextState = s.doUnbootedState(monitor)
 		case SBooting:
-			s.trace("entering state SBooting")
 			nextState = s.doBootingState()
 		case SReady:
-			s.trace("entering state SReady")
 			nextState = s.doReadyState()
 		case SCrashed:
-			s.trace("entering state SCrashed")
 			nextState = s.doCrashedState()
 		default:
 			slog.FatalErrorString("Unrecognized state: " + nextState)
@@ -170,6 +269,25 @@ func (s *SlaveNode) State() string {
 	return s.state
 }
 
+// RetryStatus reports how many automatic restarts have been attempted
+// since the node last booted or was asked to restart, out of how many
+// are allowed, and when the next one is due. next is zero if no retry
+// is pending.
+func (s *SlaveNode) RetryStatus() (attempt, limit int, next time.Time) {
+	s.L.Lock()
+	defer s.L.Unlock()
+
+	return s.attempt, s.Retries, s.nextRetry
+}
+
+// LastRestart reports why the node last restarted, or nil if it hasn't.
+func (s *SlaveNode) LastRestart() *RestartReason {
+	s.L.Lock()
+	defer s.L.Unlock()
+
+	return s.lastRestart
+}
+
 func (s *SlaveNode) HumanReadableState() string {
 	return humanreadableStates[s.state]
 }
@@ -180,6 +298,20 @@ func (s *SlaveNode) HasFeature(file string) bool {
 	return s.features[file]
 }
 
+// Features returns the files the node owns, sorted: those it loaded
+// before any node above or below it did.
+func (s *SlaveNode) Features() []string {
+	s.featureL.Lock()
+	defer s.featureL.Unlock()
+
+	features := make([]string, 0, len(s.features))
+	for file := range s.features {
+		features = append(features, file)
+	}
+	sort.Strings(features)
+	return features
+}
+
 // These "doXState" functions are called when a SlaveNode enters a state. They are expected
 // to continue to execute until
 
@@ -188,9 +320,14 @@ func (s *SlaveNode) HasFeature(file string) bool {
 // parent process to spawn a process for us and hear back from the
 // SlaveMonitor.
 func (s *SlaveNode) doUnbootedState(monitor *SlaveMonitor) string { // -> {SBooting, SCrashed}
-	if s.Parent == nil {
+	s.tree.L.RLock()
+	parent := s.Parent
+	execCommand := s.tree.ExecCommand
+	s.tree.L.RUnlock()
+
+	if parent == nil {
 		s.L.Lock()
-		parts := strings.Split(monitor.tree.ExecCommand, " ")
+		parts := strings.Split(execCommand, " ")
 		cmd := exec.Command(parts[0], parts[1:]...)
 		file := monitor.remoteMasterFile
 		env := append(os.Environ(), fmt.Sprintf("ZEUS_MASTER_FD=%d", file.Fd()))
@@ -201,15 +338,49 @@ func (s *SlaveNode) doUnbootedState(monitor *SlaveMonitor) string { // -> {SBoot
 		if runtime.GOOS == "darwin" {
 			env = append(env, "OBJC_DISABLE_INITIALIZE_FORK_SAFETY=YES")
 		}
+		for _, key := range sortedKeys(s.Env) {
+			env = append(env, key+"="+s.Env[key])
+		}
 		cmd.Env = env
 		cmd.ExtraFiles = []*os.File{file}
-		go s.babysitRootProcess(cmd)
+		output := &bytes.Buffer{}
+		cmd.Stdout = output
+		cmd.Stderr = output
+		s.rootCmd = cmd
+		// The process is started with the mutex held, so a boot
+		// timeout always finds it to kill.
+		s.trace("running the root command now")
+		if err := cmd.Start(); err != nil {
+			s.trace("root process could not start: %v", err)
+			s.Error = fmt.Sprintf("Zeus root process (%s) exited with message %s before it could boot:\n", s.Name, err)
+			s.crashRetryable = true
+			s.L.Unlock()
+			return SCrashed
+		}
+		go s.babysitRootProcess(cmd, output)
 		s.L.Unlock()
 	} else {
-		s.Parent.RequestSlaveBoot(s)
+		parent.RequestSlaveBoot(s)
 	}
 
-	<-s.event // sent by SlaveWasInitialized
+	// Only the root process is timed here: other nodes can't start
+	// booting until their parent is ready, however long that takes.
+	var timeout <-chan time.Time
+	if parent == nil && s.BootTimeout > 0 {
+		timeout = time.After(s.BootTimeout)
+	}
+
+	select {
+	case <-s.event: // sent by SlaveWasInitialized
+	case <-timeout:
+		s.L.Lock()
+		defer s.L.Unlock()
+		s.trace("root process did not start within %v", s.BootTimeout)
+		s.rootCmd.Process.Kill()
+		s.Error = s.bootTimeoutError()
+		s.crashRetryable = true
+		return SCrashed
+	}
 
 	s.L.Lock()
 	defer s.L.Unlock()
@@ -224,27 +395,43 @@ func (s *SlaveNode) doUnbootedState(monitor *SlaveMonitor) string { // -> {SBoot
 // specific to this slave). When we receive a message about the success or
 // failure of this operation, we transition to either crashed or ready.
 func (s *SlaveNode) doBootingState() string { // -> {SCrashed, SReady}
+	s.watchFiles()
+
 	// The slave will execute its action and respond with a status...
 	// Note we don't hold the mutex while waiting for the action to execute.
+	if s.BootTimeout > 0 {
+		s.socket.SetReadDeadline(time.Now().Add(s.BootTimeout))
+	}
 	msg, err := s.socket.ReadMessage()
 	if err != nil {
 		s.L.Lock()
 		defer s.L.Unlock()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			s.trace("action did not finish within %v", s.BootTimeout)
+			s.ForceKill()
+			s.wipe()
+			s.Error = s.bootTimeoutError()
+			s.crashRetryable = true
+			return SCrashed
+		}
 		s.Error = err.Error()
+		s.crashRetryable = true
 		slog.ErrorString("[" + s.Name + "] " + err.Error())
 
 		return SCrashed
 	}
+	s.socket.SetReadDeadline(time.Time{})
 
 	s.trace("received action message")
 	s.L.Lock()
 	defer s.L.Unlock()
 
-	msg, err = messages.ParseActionResponseMessage(msg)
-	if err != nil {
+	var response messages.ActionResponse
+	if err := s.codec.Decode(msg, &response); err != nil {
 		slog.ErrorString("[" + s.Name + "] " + err.Error())
+		response.Result = err.Error()
 	}
-	if msg == "OK" {
+	if response.Result == "OK" {
 		return SReady
 	}
 
@@ -253,7 +440,8 @@ func (s *SlaveNode) doBootingState() string { // -> {SCrashed, SReady}
 		syscall.Kill(s.pid, syscall.SIGKILL)
 	}
 	s.wipe()
-	s.Error = msg
+	s.Error = response.Result
+	s.crashRetryable = true
 	return SCrashed
 }
 
@@ -262,7 +450,10 @@ func (s *SlaveNode) doBootingState() string { // -> {SCrashed, SReady}
 // run commands until we receive a request to restart. This kills
 // the process and transitions to SUnbooted.
 func (s *SlaveNode) doReadyState() string { // -> SUnbooted
+	s.L.Lock()
 	s.hasSuccessfullyBooted = true
+	s.attempt = 0
+	s.L.Unlock()
 
 	// If we have a queued restart, service that rather than booting
 	// slaves or commands on potentially stale code.
@@ -288,7 +479,8 @@ func (s *SlaveNode) doReadyState() string { // -> SUnbooted
 
 // In the "SCrashed" state, we have an error message from starting
 // a process to propogate to the user and all slave nodes. We will
-// continue propogating the error until we receive a request to restart.
+// continue propogating the error until we receive a request to restart,
+// or it's time to retry.
 func (s *SlaveNode) doCrashedState() string { // -> SUnbooted
 	// If we have a queued restart, service that rather than booting
 	// slaves or commands on potentially stale code.
@@ -299,11 +491,19 @@ func (s *SlaveNode) doCrashedState() string { // -> SUnbooted
 	default:
 	}
 
+	s.L.Lock()
+	retry := s.retry
+	s.L.Unlock()
+
 	for {
 		select {
 		case <-s.needsRestart:
 			s.doRestart()
 			return SUnbooted
+		case <-retry:
+			s.trace("retrying after crash (attempt %d of %d)", s.attempt, s.Retries)
+			s.doRestart()
+			return SUnbooted
 		case slave := <-s.slaveBootRequests:
 			slave.L.Lock()
 			slave.Error = s.Error
@@ -312,17 +512,58 @@ func (s *SlaveNode) doCrashedState() string { // -> SUnbooted
 		case request := <-s.commandBootRequests:
 			s.L.Lock()
 			s.trace("reporting crash to command %v", request)
-			request.Retchan <- &CommandReply{SCrashed, nil}
+			request.reply(&CommandReply{SCrashed, nil, nil})
 			s.L.Unlock()
 		}
 	}
 }
 
+// maxRetryBackoff bounds how long the wait before a retry grows to by
+// doubling. A longer retry_backoff is used as it is.
+const maxRetryBackoff = 5 * time.Minute
+
+// retryDelay is how long to wait before the given attempt, counting
+// from 1: the backoff, doubled after each attempt up to maxRetryBackoff.
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	delay := backoff
+	for i := 1; i < attempt && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff && backoff < maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	return delay
+}
+
+// scheduleRetry arranges for a crashed node to be restarted if it
+// crashed on its own and has retries left. The mutex must be held.
+func (s *SlaveNode) scheduleRetry() {
+	s.retry = nil
+	s.nextRetry = time.Time{}
+	if !s.crashRetryable || s.attempt >= s.Retries {
+		return
+	}
+
+	s.attempt++
+	delay := retryDelay(s.RetryBackoff, s.attempt)
+	s.nextRetry = time.Now().Add(delay)
+	s.retry = time.After(delay)
+	s.trace("crashed; will retry (attempt %d of %d) in %v", s.attempt, s.Retries, delay)
+}
+
 func (s *SlaveNode) doRestart() {
 	s.L.Lock()
 	s.ForceKill()
 	s.wipe()
+	s.retry = nil
+	s.nextRetry = time.Time{}
+	reason := s.pendingRestart
 	s.L.Unlock()
+	if reason == nil {
+		// Retrying after a crash.
+		reason = &RestartReason{Node: s.Name, Time: time.Now()}
+	}
+	s.releaseSubtreeFeatures()
 
 	// Drain and ignore any enqueued slave boot requests since
 	// we're going to make them all restart again anyway.
@@ -335,8 +576,38 @@ func (s *SlaveNode) doRestart() {
 		}
 	}
 
-	for _, slave := range s.Slaves {
-		slave.RequestRestart()
+	s.tree.L.RLock()
+	slaves := s.Slaves
+	s.tree.L.RUnlock()
+	for _, slave := range slaves {
+		slave.requestRestart(reason)
+	}
+}
+
+// doRemove shuts down a node that has been removed from the plan,
+// failing any requests still waiting on it.
+func (s *SlaveNode) doRemove() {
+	s.L.Lock()
+	defer s.L.Unlock()
+
+	s.trace("removed from the plan")
+	s.releaseFeatures()
+	s.ForceKill()
+	s.wipe()
+	s.Error = fmt.Sprintf("%s was removed from the plan.\n", s.Name)
+
+	for {
+		select {
+		case request := <-s.commandBootRequests:
+			request.reply(&CommandReply{SCrashed, nil, nil})
+		case slave := <-s.slaveBootRequests:
+			slave.L.Lock()
+			slave.Error = s.Error
+			slave.ReportBootEvent()
+			slave.L.Unlock()
+		default:
+			return
+		}
 	}
 }
 
@@ -346,8 +617,11 @@ func (s *SlaveNode) bootSlave(slave *SlaveNode) {
 
 	s.trace("now sending slave boot request for %s", slave.Name)
 
-	msg := messages.CreateSpawnSlaveMessage(slave.Name)
-	_, err := s.socket.WriteMessage(msg)
+	slave.L.Lock()
+	env := slave.Env
+	slave.L.Unlock()
+
+	err := messages.Send(s.socket, s.codec, &messages.SpawnSlave{Identifier: slave.Name, Env: env})
 	if err != nil {
 		slog.Error(err)
 	}
@@ -360,11 +634,14 @@ func (s *SlaveNode) bootCommand(request *CommandRequest) {
 	s.L.Lock()
 	defer s.L.Unlock()
 
+	if request.Context.Err() != nil {
+		s.trace("dropping cancelled command boot request %v", request)
+		return
+	}
+
 	s.trace("now sending command boot request %v", request)
 
-	identifier := request.Name
-	msg := messages.CreateSpawnCommandMessage(identifier)
-	_, err := s.socket.WriteMessage(msg)
+	err := messages.Send(s.socket, s.codec, &messages.SpawnCommand{Identifier: request.Name, Env: request.Env})
 	if err != nil {
 		slog.Error(err)
 		return
@@ -377,7 +654,17 @@ func (s *SlaveNode) bootCommand(request *CommandRequest) {
 	}
 	fileName := strconv.Itoa(rand.Int())
 	commandFile := os.NewFile(uintptr(commandFD), fileName)
-	request.Retchan <- &CommandReply{s.state, commandFile}
+	if !request.reply(&CommandReply{s.state, commandFile, s.codec}) {
+		// Nobody is left to hand the command to. Closing its socket
+		// makes it exit rather than wait forever for a client.
+		s.trace("command boot request %v was cancelled while forking; closing command", request)
+		commandFile.Close()
+	}
+}
+
+func (s *SlaveNode) bootTimeoutError() string {
+	return fmt.Sprintf("Zeus gave up on %s after it spent more than %v booting, and killed it.\n"+
+		"Change a file it depends on or run `zeus restart %s` to try again.\n", s.Name, s.BootTimeout, s.Name)
 }
 
 func (s *SlaveNode) ForceKill() {
@@ -388,36 +675,39 @@ func (s *SlaveNode) ForceKill() {
 func (s *SlaveNode) wipe() {
 	s.pid = 0
 	s.socket = nil
+	s.codec = nil
 	s.Error = ""
+	s.crashRetryable = false
 }
 
-func (s *SlaveNode) babysitRootProcess(cmd *exec.Cmd) {
+// babysitRootProcess waits for the root process, which has been started
+// with its output going to output, to exit.
+func (s *SlaveNode) babysitRootProcess(cmd *exec.Cmd, output *bytes.Buffer) {
 	// We want to let this process run "forever", but it will eventually
 	// die... either on program termination or when its dependencies change
 	// and we kill it. when it's requested to restart, err is "signal 9",
 	// and we do nothing.
-	s.trace("running the root command now")
-	output, err := cmd.CombinedOutput()
-	if err == nil {
-		// TODO
-		s.trace("root process exited; output was: %s", output)
-		println(string(output))
-		/* ErrorConfigCommandCrashed(string(output)) */
-	}
-	msg := err.Error()
-	if s.hasSuccessfullyBooted == false {
-		// TODO
-		s.trace("root process exited with an error before it could boot: %s; output was: %s", msg, output)
-		println(msg)
-		/* ErrorConfigCommandCouldntStart(msg, string(output)) */
-	} else if msg == "signal 9" {
+	err := cmd.Wait()
+	msg := "exit status 0"
+	if err != nil {
+		msg = err.Error()
+	}
+
+	s.L.Lock()
+	defer s.L.Unlock()
+
+	if cmd != s.rootCmd {
+		s.trace("previous root process exited: %s; output was: %s", msg, output)
+	} else if msg == "signal 9" || msg == "signal: killed" {
 		s.trace("root process exited because we killed it & it will be restarted: %s; output was: %s", msg, output)
 	} else {
-		s.L.Lock()
-		defer s.L.Unlock()
-
 		s.trace("root process exited with error. Sending it to crashed state. Message was: %s; output: %s", msg, output)
-		s.Error = fmt.Sprintf("Zeus root process (%s) died with message %s:\n%s", s.Name, msg, output)
+		if s.hasSuccessfullyBooted {
+			s.Error = fmt.Sprintf("Zeus root process (%s) died with message %s:\n%s", s.Name, msg, output)
+		} else {
+			s.Error = fmt.Sprintf("Zeus root process (%s) exited with message %s before it could boot:\n%s", s.Name, msg, output)
+		}
+		s.crashRetryable = true
 		if !s.ReportBootEvent() {
 			s.trace("Unexpected state for root process to be in at this time: %s", s.state)
 		}
@@ -434,10 +724,8 @@ func (s *SlaveNode) handleMessages(featurePipe *os.File) {
 			return
 		} else {
 			msg = strings.TrimRight(msg, "\n")
-			s.featureL.Lock()
-			s.features[msg] = true
-			s.featureL.Unlock()
-			s.fileMonitor.Add(msg)
+			s.addFeature(msg)
+			s.watch(msg)
 		}
 	}
 }
@@ -483,6 +771,15 @@ func (s *SlaveNode) forceKillPid(pid int) error {
 	}
 }
 
+func sortedKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (s *SlaveNode) trace(format string, args ...interface{}) {
 	if !slog.TraceEnabled() {
 		return
@@ -0,0 +1,271 @@
+package processtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/unixsocket"
+	"github.com/burke/zeus/go/zeusslave"
+)
+
+// The test binary runs itself as a root process that registers but
+// never finishes booting; this variable tells it to.
+const slaveTestVar = "PROCESSTREE_TEST_SLAVE"
+
+var stalledPlan = &zeusslave.Plan{
+	Actions: map[string]func() error{
+		"boot": func() error {
+			time.Sleep(time.Hour)
+			return nil
+		},
+	},
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(slaveTestVar) != "" {
+		if err := zeusslave.Run(stalledPlan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runTree starts the slave monitor, and so the tree's nodes, until the
+// test ends.
+func runTree(t *testing.T, tree *ProcessTree) {
+	done := make(chan bool)
+	quit := StartSlaveMonitor(tree, nil, done)
+	t.Cleanup(func() {
+		close(quit)
+		<-done
+		for _, slave := range tree.AllSlaves() {
+			slave.Remove()
+		}
+	})
+}
+
+// waitForState waits for node to enter state, returning the event.
+func waitForState(t *testing.T, sub *Subscription, node, state string) Event {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-sub.C:
+			if event.Kind == EventStateChanged && event.Node == node && event.State == state {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s to become %s", node, StateName(state))
+		}
+	}
+}
+
+// waitForExit waits for the process to be killed and reaped.
+func waitForExit(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !errors.Is(syscall.Kill(pid, 0), syscall.ESRCH) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected process %d to be killed", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBootTimeoutKillsRootThatNeverRegisters(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	tree.ExecCommand = "sleep 60"
+	boot := tree.Root
+	boot.BootTimeout = 200 * time.Millisecond
+	sub := tree.Subscribe()
+	defer sub.Close()
+	runTree(t, tree)
+
+	event := waitForState(t, sub, "boot", SCrashed)
+	if expected := boot.bootTimeoutError(); event.Error != expected {
+		t.Errorf("expected error %q, got %q", expected, event.Error)
+	}
+	boot.L.Lock()
+	pid := boot.rootCmd.Process.Pid
+	boot.L.Unlock()
+	waitForExit(t, pid)
+}
+
+func TestBootTimeoutKillsActionThatNeverAnswers(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	tree.ExecCommand = executable
+	boot := tree.Root
+	boot.Env = map[string]string{slaveTestVar: "1"}
+	boot.BootTimeout = time.Second
+	sub := tree.Subscribe()
+	defer sub.Close()
+	runTree(t, tree)
+
+	booting := waitForState(t, sub, "boot", SBooting)
+	event := waitForState(t, sub, "boot", SCrashed)
+	if expected := boot.bootTimeoutError(); event.Error != expected {
+		t.Errorf("expected error %q, got %q", expected, event.Error)
+	}
+	waitForExit(t, booting.Pid)
+}
+
+// slavePair gives node a socket to a slave, returning the slave's end.
+func slavePair(t *testing.T, node *SlaveNode) *unixsocket.Usock {
+	local, remote, err := unixsocket.Socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := unixsocket.NewFromFile(local)
+	local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave, err := unixsocket.NewFromFile(remote)
+	remote.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		master.Close()
+		slave.Close()
+	})
+
+	node.socket, node.codec, node.state = master, messages.JSON, SReady
+	return slave
+}
+
+func TestBootCommandDropsCancelledRequest(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	slave := slavePair(t, tree.Root)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan bool)
+	go func() {
+		tree.Root.bootCommand(&CommandRequest{Name: "test", Retchan: make(chan *CommandReply), Context: ctx})
+		close(done)
+	}()
+
+	slave.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if msg, err := slave.ReadMessage(); err == nil {
+		t.Errorf("expected no command to be forked, but the slave was sent %q", msg)
+		// Hang up rather than send the command.
+		slave.Close()
+	}
+	<-done
+}
+
+func TestBootCommandClosesCommandNobodyReceives(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	slave := slavePair(t, tree.Root)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, runner, err := unixsocket.Socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, err := unixsocket.NewFromFile(local)
+	local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer command.Close()
+
+	// The client gives up while the slave is forking the command.
+	go func() {
+		defer runner.Close()
+		slave.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := slave.ReadMessage(); err != nil {
+			t.Error(err)
+			return
+		}
+		cancel()
+		slave.WriteFD(int(runner.Fd()))
+	}()
+	tree.Root.bootCommand(&CommandRequest{Name: "test", Retchan: make(chan *CommandReply), Context: ctx})
+
+	// With the master's copy of the socket closed too, the command
+	// sees it hang up.
+	command.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if msg, err := command.ReadMessage(); err != io.EOF {
+		t.Errorf("expected the command's socket to be closed, got %q and %v", msg, err)
+	}
+}
+
+func TestRetryBackoffIsCapped(t *testing.T) {
+	cases := []struct {
+		backoff  time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 4, 8 * time.Second},
+		{time.Second, 9, 256 * time.Second},
+		{time.Second, 10, maxRetryBackoff},
+		// Doubling this many times would overflow.
+		{time.Second, 100, maxRetryBackoff},
+		{time.Hour, 3, time.Hour},
+	}
+	for _, c := range cases {
+		if actual := retryDelay(c.backoff, c.attempt); actual != c.expected {
+			t.Errorf("%v, attempt %d: expected %v, got %v", c.backoff, c.attempt, c.expected, actual)
+		}
+	}
+
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	node := tree.Root
+	node.Retries, node.RetryBackoff = 1000, time.Second
+	for i := 0; i < node.Retries; i++ {
+		node.crashRetryable = true
+		node.scheduleRetry()
+	}
+	if wait := time.Until(node.nextRetry); wait <= maxRetryBackoff-time.Minute || wait > maxRetryBackoff {
+		t.Errorf("expected the last of %d retries to wait about %v, got %v", node.Retries, maxRetryBackoff, wait)
+	}
+}
+
+func TestCrashedNodeRetries(t *testing.T) {
+	tree := buildTree(map[string]string{"boot": ""}, nil)
+	// The root process exits before it can boot.
+	tree.ExecCommand = "false"
+	boot := tree.Root
+	boot.Retries, boot.RetryBackoff = 2, 50*time.Millisecond
+	sub := tree.Subscribe()
+	defer sub.Close()
+	runTree(t, tree)
+
+	waitForState(t, sub, "boot", SUnbooted)
+	crashed := waitForState(t, sub, "boot", SCrashed)
+	for attempt := 1; attempt <= boot.Retries; attempt++ {
+		retried := waitForState(t, sub, "boot", SUnbooted)
+		if wait, backoff := retried.Time.Sub(crashed.Time), retryDelay(boot.RetryBackoff, attempt); wait < backoff {
+			t.Errorf("attempt %d: expected to wait %v before retrying, but waited %v", attempt, backoff, wait)
+		}
+		crashed = waitForState(t, sub, "boot", SCrashed)
+	}
+
+	// Out of retries, the node stays crashed, for longer than another
+	// retry would have waited.
+	select {
+	case event := <-sub.C:
+		t.Errorf("expected no more retries, got %+v", event)
+	case <-time.After(2 * retryDelay(boot.RetryBackoff, boot.Retries+1)):
+	}
+	if attempt, limit, next := boot.RetryStatus(); attempt != limit || !next.IsZero() {
+		t.Errorf("expected %d of %d attempts and no retry pending, got %d and %v", limit, limit, attempt, next)
+	}
+}
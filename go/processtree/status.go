@@ -0,0 +1,109 @@
+package processtree
+
+import "time"
+
+// NodeStatus is a point-in-time snapshot of a SlaveNode, suitable for
+// reporting to clients.
+type NodeStatus struct {
+	Name   string `json:"name"`
+	Parent string `json:"parent,omitempty"`
+	Depth  int    `json:"depth"`
+	State  string `json:"state"`
+	Pid    int    `json:"pid"`
+	Error  string `json:"error,omitempty"`
+
+	// Automatic restarts attempted since the node last booted, out of
+	// Retries, and when the next is due if one is pending.
+	Attempt   int        `json:"attempt,omitempty"`
+	Retries   int        `json:"retries,omitempty"`
+	NextRetry *time.Time `json:"next_retry,omitempty"`
+
+	// LastRestart is why the node last restarted, if it has.
+	LastRestart *RestartReason `json:"last_restart,omitempty"`
+}
+
+// CommandStatus is a point-in-time snapshot of a CommandNode. A command
+// is runnable when the slave it forks from is ready.
+type CommandStatus struct {
+	Name     string   `json:"name"`
+	Aliases  []string `json:"aliases"`
+	Node     string   `json:"node"`
+	Runnable bool     `json:"runnable"`
+}
+
+// TreeStatus is a snapshot of every node and command in a ProcessTree.
+// Nodes are listed depth-first, starting at the root.
+type TreeStatus struct {
+	Nodes    []NodeStatus    `json:"nodes"`
+	Commands []CommandStatus `json:"commands"`
+
+	// FileMonitorDegraded explains how the file monitor is watching
+	// files less well than it should, if it is.
+	FileMonitorDegraded string `json:"file_monitor_degraded,omitempty"`
+}
+
+// Status takes a snapshot of the state of the tree.
+func (tree *ProcessTree) Status() *TreeStatus {
+	tree.L.RLock()
+	defer tree.L.RUnlock()
+
+	status := &TreeStatus{
+		Nodes:               []NodeStatus{},
+		Commands:            []CommandStatus{},
+		FileMonitorDegraded: tree.FileMonitorDegraded(),
+	}
+	if tree.Root != nil {
+		tree.Root.appendStatus(status, 0)
+	}
+
+	for _, command := range tree.Commands {
+		aliases := command.Aliases
+		if aliases == nil {
+			aliases = []string{}
+		}
+		status.Commands = append(status.Commands, CommandStatus{
+			Name:     command.Name,
+			Aliases:  aliases,
+			Node:     command.Parent.Name,
+			Runnable: command.Parent.State() == SReady,
+		})
+	}
+
+	return status
+}
+
+// Status takes a snapshot of the state of the node.
+func (s *SlaveNode) Status() NodeStatus {
+	s.L.Lock()
+	defer s.L.Unlock()
+
+	node := NodeStatus{
+		Name:  s.Name,
+		State: humanreadableStates[s.state],
+		Pid:   s.pid,
+		Error: s.Error,
+
+		Attempt: s.attempt,
+		Retries: s.Retries,
+
+		LastRestart: s.lastRestart,
+	}
+	if !s.nextRetry.IsZero() {
+		next := s.nextRetry
+		node.NextRetry = &next
+	}
+	if s.Parent != nil {
+		node.Parent = s.Parent.Name
+	}
+	return node
+}
+
+func (s *SlaveNode) appendStatus(status *TreeStatus, depth int) {
+	node := s.Status()
+	node.Depth = depth
+	status.Nodes = append(status.Nodes, node)
+
+	for _, slave := range s.Slaves {
+		slave.appendStatus(status, depth+1)
+	}
+}
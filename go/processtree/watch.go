@@ -0,0 +1,78 @@
+package processtree
+
+// Nodes can watch files they don't load, such as config/database.yml or
+// .env, with the Watch globs in their config. These are treated like the
+// files the node loaded: a change to one restarts the node.
+
+import (
+	"github.com/burke/zeus/go/filemonitor"
+	slog "github.com/burke/zeus/go/shinylog"
+)
+
+// watchFiles adds the files and directories the node's Watch globs
+// match to the file monitor. It's done each time the node boots, so new
+// directories are picked up.
+func (s *SlaveNode) watchFiles() {
+	s.tree.L.RLock()
+	globs := s.Watch
+	ignore := s.tree.WatchIgnore
+	s.tree.L.RUnlock()
+	if len(globs) == 0 || s.fileMonitor == nil {
+		return
+	}
+
+	for _, glob := range globs {
+		files, dirs := glob.Expand(ignore)
+		for _, file := range append(dirs, files...) {
+			s.watch(file)
+		}
+	}
+}
+
+// watch adds file to the file monitor. A file that can't be watched
+// won't restart the node when it changes, so the error is traced, and
+// so is the monitor running short of watches.
+func (s *SlaveNode) watch(file string) {
+	if err := s.fileMonitor.Add(file); err != nil {
+		s.trace("couldn't watch %s: %v", file, err)
+	}
+	s.tree.CheckFileMonitor(s.fileMonitor)
+}
+
+// CheckFileMonitor publishes an EventFileMonitorDegraded when monitor
+// starts watching files less well than it should, or does so in a new
+// way. It's called whenever a file is added to the monitor, and now and
+// then by the master, as a monitor can degrade on its own.
+func (tree *ProcessTree) CheckFileMonitor(monitor filemonitor.FileMonitor) {
+	degraded := monitor.Degraded()
+
+	tree.monitorL.Lock()
+	changed := degraded != tree.monitorDegraded
+	tree.monitorDegraded = degraded
+	tree.monitorL.Unlock()
+
+	if changed && degraded != "" {
+		slog.Trace("the file monitor is degraded: %s", degraded)
+		tree.publish(Event{Kind: EventFileMonitorDegraded, Error: degraded})
+	}
+}
+
+// FileMonitorDegraded explains how the file monitor is watching files
+// less well than it should. It's empty if the monitor is working as
+// intended.
+func (tree *ProcessTree) FileMonitorDegraded() string {
+	tree.monitorL.Lock()
+	defer tree.monitorL.Unlock()
+	return tree.monitorDegraded
+}
+
+// watches reports whether the node's Watch globs cover file. The tree's
+// lock must be held.
+func (s *SlaveNode) watches(file string) bool {
+	for _, glob := range s.Watch {
+		if glob.Match(file) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package processtree
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/burke/zeus/go/filemonitor"
+)
+
+// recordingMonitor remembers the files added to it.
+type recordingMonitor struct {
+	added    []string
+	degraded string
+}
+
+func (m *recordingMonitor) Listen() <-chan []string       { return nil }
+func (m *recordingMonitor) Close() error                  { return nil }
+func (m *recordingMonitor) SetIgnore(*filemonitor.Ignore) {}
+func (m *recordingMonitor) Degraded() string              { return m.degraded }
+func (m *recordingMonitor) Add(file string) error {
+	m.added = append(m.added, file)
+	return nil
+}
+
+func TestWatchedFilesRestartNodes(t *testing.T) {
+	root := t.TempDir()
+	for _, file := range []string{"config/database.yml", "config/locales/en.yml", "config/locales/fr/fr.yml", "config/locales/README"} {
+		path := filepath.Join(root, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree := featureTree()
+	nodes := tree.SlavesByName
+	monitor := &recordingMonitor{}
+	nodes["default_bundle"].Watch = []filemonitor.Glob{
+		filemonitor.Glob(filepath.Join(root, "config/database.yml")),
+		filemonitor.Glob(filepath.Join(root, ".env")),
+	}
+	nodes["development"].Watch = []filemonitor.Glob{filemonitor.Glob(filepath.Join(root, "config/locales/**/*.yml"))}
+	for _, node := range nodes {
+		node.fileMonitor = monitor
+		node.watchFiles()
+	}
+
+	sort.Strings(monitor.added)
+	expected := []string{"", ".env", "config", "config/database.yml", "config/locales", "config/locales/en.yml", "config/locales/fr", "config/locales/fr/fr.yml"}
+	for i := range expected {
+		expected[i] = filepath.Join(root, expected[i])
+	}
+	if !reflect.DeepEqual(monitor.added, expected) {
+		t.Errorf("expected %q to be watched, got %q", expected, monitor.added)
+	}
+
+	cases := []struct {
+		changed  string
+		expected []string
+	}{
+		{"config/database.yml", []string{"default_bundle"}},
+		// Created since the node booted.
+		{"config/locales/de.yml", []string{"development"}},
+		{".env", []string{"default_bundle"}},
+		{"config/locales/fr", nil},
+		{"config/locales/README", nil},
+	}
+	for _, c := range cases {
+		for _, node := range nodes {
+			select {
+			case <-node.needsRestart:
+			default:
+			}
+		}
+		tree.RestartNodesWithFeatures([]string{filepath.Join(root, c.changed)})
+		if actual := restarted(tree); !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s: expected %q to restart, got %q", c.changed, c.expected, actual)
+		}
+	}
+}
+
+func TestFileMonitorDegradedEvents(t *testing.T) {
+	tree := featureTree()
+	sub := tree.Subscribe()
+	defer sub.Close()
+	monitor := &recordingMonitor{}
+	node := tree.SlavesByName["default_bundle"]
+	node.fileMonitor = monitor
+
+	node.watch("/app/Gemfile")
+	monitor.degraded = "some files are polled"
+	node.watch("/app/Gemfile.lock")
+	node.watch("/app/config/application.rb")
+
+	if len(sub.C) != 1 {
+		t.Fatalf("expected one event, got %d", len(sub.C))
+	}
+	if event := <-sub.C; event.Kind != EventFileMonitorDegraded || event.Error != monitor.degraded {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if status := tree.Status(); status.FileMonitorDegraded != monitor.degraded {
+		t.Errorf("expected the status to say the monitor is degraded, got %q", status.FileMonitorDegraded)
+	}
+}
@@ -16,6 +16,7 @@ const updateDebounceInterval = 1 * time.Millisecond
 type StatusChart struct {
 	RootSlave *processtree.SlaveNode
 	update    chan bool
+	tree      *processtree.ProcessTree
 
 	numberOfSlaves int
 	Commands       []*processtree.CommandNode
@@ -26,6 +27,9 @@ type StatusChart struct {
 
 	extraOutput       string
 	terminalSupported bool
+	// drawnWarning is the warning at the top of the chart as last drawn,
+	// or logged.
+	drawnWarning string
 
 	previousStates []*string
 }
@@ -36,9 +40,8 @@ func Start(tree *processtree.ProcessTree, done chan bool, simple bool) chan bool
 	quit := make(chan bool)
 
 	theChart = &StatusChart{}
-	theChart.RootSlave = tree.Root
-	theChart.numberOfSlaves = len(tree.SlavesByName)
-	theChart.Commands = tree.Commands
+	theChart.tree = tree
+	theChart.refresh()
 	theChart.update = make(chan bool)
 	theChart.directLogger = slog.NewShinyLogger(os.Stdout, os.Stderr)
 	theChart.terminalSupported = ttyutils.IsTerminal(os.Stdout.Fd())
@@ -53,13 +56,15 @@ func Start(tree *processtree.ProcessTree, done chan bool, simple bool) chan bool
 		}
 	}
 
-	go theChart.watchUpdates(tree.StateChanged)
+	go theChart.watchUpdates(tree.Subscribe(), quit)
 
 	return quit
 }
 
 func startLineOutput(tree *processtree.ProcessTree, done, quit chan bool) {
 	states := make(map[string]string)
+	restarts := make(map[string]*processtree.RestartReason)
+	var warning string
 
 	go func() {
 		for {
@@ -68,11 +73,28 @@ func startLineOutput(tree *processtree.ProcessTree, done, quit chan bool) {
 				done <- true
 				return
 			case <-theChart.update:
-				for name, slave := range tree.SlavesByName {
+				if w := degradedWarning(tree); w != warning {
+					if w != "" {
+						fmt.Println(w)
+					}
+					warning = w
+				}
+				for _, slave := range tree.AllSlaves() {
+					name := slave.Name
 					state, found := states[name]
-					if !found || (state != slave.State()) {
-						fmt.Println("environment: " + name + " status: " + slave.HumanReadableState())
+					// A node that restarts on its own may be booting
+					// again by now, so the restart is reported whatever
+					// state it's in.
+					restart := slave.LastRestart()
+					restarted := restart != restarts[name]
+					if !found || state != slave.State() || restarted {
+						line := "environment: " + name + " status: " + slave.HumanReadableState() + retrySuffix(slave)
+						if restarted && restart != nil {
+							line += " (" + restart.Describe(name) + ")"
+						}
+						fmt.Println(line)
 						states[name] = slave.State()
+						restarts[name] = restart
 					}
 				}
 			}
@@ -80,17 +102,40 @@ func startLineOutput(tree *processtree.ProcessTree, done, quit chan bool) {
 	}()
 }
 
-func (s *StatusChart) watchUpdates(updates <-chan bool) {
+// refresh picks up changes to the shape of the tree, which happen when
+// the config file is reloaded.
+func (s *StatusChart) refresh() {
+	s.tree.L.RLock()
+	s.RootSlave = s.tree.Root
+	s.numberOfSlaves = len(s.tree.SlavesByName)
+	s.tree.L.RUnlock()
+
+	s.Commands = s.tree.AllCommands()
+}
+
+func (s *StatusChart) watchUpdates(sub *processtree.Subscription, quit <-chan bool) {
+	defer sub.Close()
+
 	// Debounce state updates
-	for <-updates {
-		reported := false
+	for {
+		select {
+		case <-sub.C:
+		case <-quit:
+			return
+		}
 		timeout := time.After(updateDebounceInterval)
-		for !reported {
+		for reported := false; !reported; {
 			select {
-			case <-updates:
+			case <-sub.C:
 			case <-timeout:
-				s.update <- true
+				select {
+				case s.update <- true:
+				case <-quit:
+					return
+				}
 				reported = true
+			case <-quit:
+				return
 			}
 		}
 	}
@@ -115,6 +160,39 @@ func stateSuffix(state string) string {
 	return status
 }
 
+// degradedWarning warns that the file monitor is watching files less
+// well than it should, if it is: changes to some files may be missed or
+// noticed late.
+func degradedWarning(tree *processtree.ProcessTree) string {
+	if degraded := tree.FileMonitorDegraded(); degraded != "" {
+		return "warning: " + degraded
+	}
+	return ""
+}
+
+// retrySuffix describes a crashed node's automatic restarts, if any.
+func retrySuffix(node *processtree.SlaveNode) string {
+	if node.State() != processtree.SCrashed {
+		return ""
+	}
+	attempt, limit, next := node.RetryStatus()
+	if !next.IsZero() {
+		return fmt.Sprintf(" (retry %d/%d at %s)", attempt, limit, next.Format("15:04:05"))
+	}
+	if limit > 0 && attempt >= limit {
+		return fmt.Sprintf(" (gave up after %d retries)", limit)
+	}
+	return ""
+}
+
+// restartSuffix explains why the node last restarted, if it has.
+func restartSuffix(node *processtree.SlaveNode) string {
+	if reason := node.LastRestart(); reason != nil {
+		return " (" + reason.Describe(node.Name) + ")"
+	}
+	return ""
+}
+
 func printStateInfo(indentation, identifier, state string, verbose, printNewline bool) {
 	log := theChart.directLogger
 	newline := ""
@@ -25,9 +25,18 @@ func (s *StatusChart) logChanges() {
 	s.L.Lock()
 	defer s.L.Unlock()
 	log := theChart.directLogger
+	s.refresh()
 
+	if warning := degradedWarning(s.tree); warning != s.drawnWarning {
+		if warning != "" {
+			log.Colorized("{red}" + warning + "{reset}")
+		}
+		s.drawnWarning = warning
+	}
 	log.ColorizedSansNl("{reset}Status: ")
+	s.tree.L.RLock()
 	s.logSubtree(s.RootSlave)
+	s.tree.L.RUnlock()
 	log.Colorized("{reset}")
 	s.logCommands()
 }
@@ -77,7 +86,7 @@ func (s *StatusChart) logCommands() {
 
 func (s *StatusChart) logSubtree(node *processtree.SlaveNode) {
 	log := theChart.directLogger
-	printStateInfo("", node.Name, node.State(), true, false)
+	printStateInfo("", node.Name+retrySuffix(node), node.State(), true, false)
 
 	if len(node.Slaves) > 0 {
 		log.ColorizedSansNl("{reset}(")
@@ -57,24 +57,51 @@ func (s *StatusChart) draw() {
 
 	if s.drawnInitial {
 		lengthOfOutput := s.lengthOfOutput()
-		numberOfOutputLines := s.numberOfSlaves + len(s.Commands) + lengthOfOutput + 3
+		numberOfOutputLines := s.numberOfSlaves + len(s.Commands) + lengthOfOutput + s.lengthOfWarning() + 3
 		fmt.Printf("\033[%dA", numberOfOutputLines)
 	} else {
 		s.drawnInitial = true
 	}
+	s.refresh()
 
 	log := theChart.directLogger
 
+	s.drawnWarning = degradedWarning(s.tree)
+	if s.drawnWarning != "" {
+		log.Colorized("{red}" + s.drawnWarning + "\033[K")
+	}
 	log.Colorized("\x1b[4m{green}[ready] {red}[crashed] {blue}[running] {magenta}[connecting] {yellow}[waiting]\033[K")
+	s.tree.L.RLock()
 	s.drawSubtree(s.RootSlave, "", "")
+	s.tree.L.RUnlock()
 
 	log.Colorized("\033[K\n\x1b[4mAvailable Commands: {yellow}[waiting] {red}[crashed] {green}[ready]\033[K")
 	s.drawCommands()
 	output := strings.Replace(s.extraOutput, "\n", "\033[K\n", -1)
 	fmt.Printf(output)
+	// Clear anything left over from a taller chart.
+	fmt.Printf("\033[J")
 }
 
 func (s *StatusChart) lengthOfOutput() int {
+	// extraOutput ends with a newline, after which nothing is drawn.
+	if lines := linesOnTerminal(s.extraOutput); lines > 0 {
+		return lines - 1
+	}
+	return 0
+}
+
+// lengthOfWarning is how many lines the warning last drawn took up.
+func (s *StatusChart) lengthOfWarning() int {
+	if s.drawnWarning == "" {
+		return 0
+	}
+	return linesOnTerminal(s.drawnWarning)
+}
+
+// linesOnTerminal is how many lines text takes up once long lines wrap,
+// or 0 if the terminal's width isn't known.
+func linesOnTerminal(text string) int {
 	ts, err := ttyutils.Winsize(os.Stdout)
 	if err != nil {
 		// This can happen when the output is redirected to a device
@@ -86,7 +113,7 @@ func (s *StatusChart) lengthOfOutput() int {
 		return 0
 	}
 
-	lines := strings.Split(s.extraOutput, "\n")
+	lines := strings.Split(text, "\n")
 
 	numLines := 0
 	for _, line := range lines {
@@ -97,7 +124,7 @@ func (s *StatusChart) lengthOfOutput() int {
 		numLines += n
 	}
 
-	return numLines - 1
+	return numLines
 }
 
 func (s *StatusChart) drawCommands() {
@@ -128,7 +155,7 @@ func (s *StatusChart) drawCommands() {
 }
 
 func (s *StatusChart) drawSubtree(node *processtree.SlaveNode, myIndentation, childIndentation string) {
-	printStateInfo(myIndentation, node.Name, node.State(), false, true)
+	printStateInfo(myIndentation, node.Name+retrySuffix(node)+restartSuffix(node), node.State(), false, true)
 
 	for i, slave := range node.Slaves {
 		if i == len(node.Slaves)-1 {
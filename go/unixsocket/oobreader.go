@@ -37,6 +37,11 @@ func (o *oobReader) ReadFD() (int, error) {
 
 func (o *oobReader) Read(b []byte) (int, error) {
 	n, oobn, _, _, err := o.Conn.ReadMsgUnix(b, o.oob)
+	if n < 0 {
+		// A failed read on a closed connection reports -1, which
+		// bufio.Reader treats as a fatal programming error.
+		n = 0
+	}
 	if oobn > 0 {
 		newOob := make([]byte, oobn)
 		copy(newOob, o.oob[:oobn])
@@ -19,6 +19,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
 )
 
@@ -34,7 +35,7 @@ func Socketpair(typ int) (a, b *os.File, err error) {
 	return
 }
 
-var sockName string
+var sockName, startDir string
 
 func containsFile(pattern string, files []os.FileInfo) bool {
 	for _, f := range files {
@@ -49,12 +50,21 @@ func containsFile(pattern string, files []os.FileInfo) bool {
 	return false
 }
 
+// projectRootFiles mark the project root: a Gemfile, or a config file
+// for projects in other languages.
+var projectRootFiles = []string{"*Gemfile", "zeus.json", "zeus.yml", "zeus.yaml", "zeus.toml"}
+
 func isProjectRoot(p string) bool {
 	files, err := ioutil.ReadDir(p)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return containsFile("*Gemfile", files)
+	for _, pattern := range projectRootFiles {
+		if containsFile(pattern, files) {
+			return true
+		}
+	}
+	return false
 }
 
 func projectRoot() string {
@@ -73,6 +83,7 @@ func projectRoot() string {
 }
 
 func init() {
+	startDir, _ = os.Getwd()
 	sockName = os.Getenv("ZEUSSOCK")
 	if sockName == "" {
 		os.Chdir(projectRoot())
@@ -90,3 +101,16 @@ func SetZeusSockName(n string) {
 func ZeusSockName() string {
 	return sockName
 }
+
+// ControlSockName returns the name of the master's JSON-RPC control
+// socket, which sits next to the client socket: .zeus.control.sock for
+// .zeus.sock.
+func ControlSockName() string {
+	return strings.TrimSuffix(sockName, ".sock") + ".control.sock"
+}
+
+// StartDir returns the directory the process was started in, before it
+// moved to the project root.
+func StartDir() string {
+	return startDir
+}
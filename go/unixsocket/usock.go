@@ -10,13 +10,18 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Usock struct {
 	reader *oobReader
 	rbuf   *bufio.Reader
 
-	sync.Mutex
+	// Reads and writes are locked independently so that a goroutine
+	// blocked waiting for a message doesn't prevent replies from being
+	// written.
+	rmu sync.Mutex
+	wmu sync.Mutex
 }
 
 func New(conn *net.UnixConn) *Usock {
@@ -48,9 +53,15 @@ func (u *Usock) Close() {
 	u.reader.Conn.Close()
 }
 
+// SetReadDeadline sets the deadline for future reads. A zero value
+// means reads will not time out.
+func (u *Usock) SetReadDeadline(t time.Time) error {
+	return u.reader.Conn.SetReadDeadline(t)
+}
+
 func (u *Usock) ReadMessage() (s string, err error) {
-	u.Lock()
-	defer u.Unlock()
+	u.rmu.Lock()
+	defer u.rmu.Unlock()
 
 	for {
 		s, err = u.rbuf.ReadString(0)
@@ -64,8 +75,8 @@ func (u *Usock) ReadMessage() (s string, err error) {
 }
 
 func (u *Usock) WriteMessage(msg string) (int, error) {
-	u.Lock()
-	defer u.Unlock()
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
 
 	completeMessage := strings.NewReader(msg + "\000")
 	n, err := io.Copy(u.reader.Conn, completeMessage)
@@ -73,15 +84,15 @@ func (u *Usock) WriteMessage(msg string) (int, error) {
 }
 
 func (u *Usock) ReadFD() (int, error) {
-	u.Lock()
-	defer u.Unlock()
+	u.rmu.Lock()
+	defer u.rmu.Unlock()
 
 	return u.reader.ReadFD()
 }
 
 func (u *Usock) WriteFD(fd int) error {
-	u.Lock()
-	defer u.Unlock()
+	u.wmu.Lock()
+	defer u.wmu.Unlock()
 
 	rights := syscall.UnixRights(fd)
 
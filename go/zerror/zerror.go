@@ -54,14 +54,11 @@ func ErrorConfigCommandCrashed(output string) {
 // The config file is loaded before any goroutines are launched that require cleanup,
 // and our exitNow goroutine has not been spawned yet, so we will just explicitly exit
 // in the json-related errors..
-func ErrorConfigFileInvalidJSON() {
-	if slog.Red("The config file {yellow}zeus.json{red} contains invalid JSON and could not be parsed.") {
-		os.Exit(1)
-	}
-}
-
-func ErrorConfigFileInvalidFormat() {
-	if slog.Red("The config file {yellow}zeus.json{red} is not in the correct format.") {
+func ErrorConfigFileInvalid(file string, problems []string) {
+	if slog.Red("The config file {yellow}" + file + "{red} is not valid:") {
+		for _, problem := range problems {
+			slog.Red("  " + problem)
+		}
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,180 @@
+package zeusclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/processtree"
+	slog "github.com/burke/zeus/go/shinylog"
+)
+
+// Status asks a running master for the state of every node and command
+// and prints it to out, either for humans or as JSON.
+func Status(out io.Writer, asJSON bool) int {
+	usock, err := dialMaster()
+	if err != nil {
+		return 1
+	}
+	defer usock.Close()
+
+	reply, err := controlRequest(usock, messages.ControlStatus)
+	if err != nil {
+		slog.StdErrorString(err.Error())
+		return 1
+	}
+
+	var status processtree.TreeStatus
+	if err := json.Unmarshal([]byte(reply), &status); err != nil {
+		slog.StdErrorString("Could not parse status from master: " + err.Error())
+		return 1
+	}
+
+	if asJSON {
+		data, _ := json.MarshalIndent(status, "", "  ")
+		fmt.Fprintln(out, string(data))
+	} else {
+		printStatus(out, &status)
+	}
+	return 0
+}
+
+// Restart asks a running master to restart a single node and its
+// descendants.
+func Restart(node string) int {
+	usock, err := dialMaster()
+	if err != nil {
+		return 1
+	}
+	defer usock.Close()
+
+	if _, err := controlRequest(usock, messages.ControlRestart, node); err != nil {
+		slog.StdErrorString(err.Error())
+		return 1
+	}
+	println("Restarting " + node + "...")
+	return 0
+}
+
+// Exit codes for Wait.
+const (
+	WaitReady    = 0
+	WaitCrashed  = 1
+	WaitTimedOut = 124 // As timeout(1) does
+)
+
+// Wait blocks until target (a node or command name, or the whole tree
+// when empty) is ready, it crashes, or the timeout elapses. A zero
+// timeout waits indefinitely.
+func Wait(target string, timeout time.Duration, stderr io.Writer) int {
+	usock, err := dialMaster()
+	if err != nil {
+		return WaitCrashed
+	}
+	defer usock.Close()
+
+	type result struct {
+		reply string
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		reply, err := controlRequest(usock, messages.ControlWait, target)
+		results <- result{reply, err}
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	var res result
+	select {
+	case res = <-results:
+	case <-expired:
+		if target == "" {
+			target = "all nodes"
+		}
+		slog.StdErrorString(fmt.Sprintf("Timed out after %v waiting for %s.", timeout, target))
+		return WaitTimedOut
+	}
+	if res.err != nil {
+		slog.StdErrorString(res.err.Error())
+		return WaitCrashed
+	}
+
+	var node processtree.NodeStatus
+	if err := json.Unmarshal([]byte(res.reply), &node); err != nil {
+		slog.StdErrorString("Could not parse status from master: " + err.Error())
+		return WaitCrashed
+	}
+	if node.State == "crashed" {
+		fmt.Fprintf(stderr, "%s crashed:\n%s", node.Name, node.Error)
+		return WaitCrashed
+	}
+	return WaitReady
+}
+
+func controlRequest(usock *masterConn, op string, args ...string) (string, error) {
+	if err := messages.Send(usock, usock.codec, &messages.Control{Op: op, Args: args}); err != nil {
+		return "", err
+	}
+	reply, err := usock.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(reply, "ERROR:") {
+		return "", errors.New(reply)
+	}
+	return reply, nil
+}
+
+func printStatus(out io.Writer, status *processtree.TreeStatus) {
+	if status.FileMonitorDegraded != "" {
+		fmt.Fprintln(out, "warning: "+status.FileMonitorDegraded)
+		fmt.Fprintln(out)
+	}
+	for _, node := range status.Nodes {
+		line := strings.Repeat("  ", node.Depth) + node.Name + ": " + node.State
+		if node.Pid > 0 {
+			line += fmt.Sprintf(" (pid %d)", node.Pid)
+		}
+		if node.NextRetry != nil {
+			line += fmt.Sprintf(" (retry %d/%d at %s)", node.Attempt, node.Retries, node.NextRetry.Format("15:04:05"))
+		} else if node.State == "crashed" && node.Retries > 0 && node.Attempt >= node.Retries {
+			line += fmt.Sprintf(" (gave up after %d retries)", node.Retries)
+		}
+		if node.LastRestart != nil {
+			line += " (" + node.LastRestart.Describe(node.Name) + ")"
+		}
+		fmt.Fprintln(out, line)
+		if node.Error != "" {
+			indent := strings.Repeat("  ", node.Depth+2)
+			fmt.Fprintln(out, indent+strings.Replace(strings.TrimRight(node.Error, "\n"), "\n", "\n"+indent, -1))
+		}
+	}
+
+	nodeStates := make(map[string]string, len(status.Nodes))
+	for _, node := range status.Nodes {
+		nodeStates[node.Name] = node.State
+	}
+
+	fmt.Fprintln(out)
+	for _, command := range status.Commands {
+		var aliasPart string
+		if len(command.Aliases) > 0 {
+			aliasPart = " (alias: " + strings.Join(command.Aliases, ", ") + ")"
+		}
+		state := "waiting"
+		if command.Runnable {
+			state = "ready"
+		} else if nodeStates[command.Node] == "crashed" {
+			state = "crashed"
+		}
+		fmt.Fprintf(out, "zeus %s%s [%s]\n", command.Name, aliasPart, state)
+	}
+}
@@ -0,0 +1,106 @@
+package zeusclient
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+// fakeMaster answers the next control request with reply, or never
+// answers if reply is empty. It returns the requests it receives.
+func fakeMaster(t *testing.T, reply string) <-chan *messages.Control {
+	sockName := filepath.Join(t.TempDir(), ".zeus.sock")
+	unixsocket.SetZeusSockName(sockName)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: sockName, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	requests := make(chan *messages.Control, 1)
+	go func() {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		usock := unixsocket.New(conn)
+		defer usock.Close()
+
+		codec, msg, err := messages.Accept(usock)
+		var request messages.Control
+		if err == nil {
+			err = codec.Decode(msg, &request)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		requests <- &request
+		if reply != "" {
+			usock.WriteMessage(reply)
+		}
+		// Hold the connection open until the client is done with it.
+		usock.ReadMessage()
+	}()
+	return requests
+}
+
+func TestWaitExitCodes(t *testing.T) {
+	cases := []struct {
+		name     string
+		reply    string
+		timeout  time.Duration
+		expected int
+		stderr   string
+	}{
+		{"ready", `{"name":"child","state":"ready"}`, 0, WaitReady, ""},
+		{"crashed", `{"name":"child","state":"crashed","error":"boom\n"}`, 0, WaitCrashed, "child crashed:\nboom\n"},
+		{"unknown", "ERROR: Node not found!: test", 0, WaitCrashed, ""},
+		{"timed out", "", 100 * time.Millisecond, WaitTimedOut, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests := fakeMaster(t, c.reply)
+
+			var stderr bytes.Buffer
+			if code := Wait("test", c.timeout, &stderr); code != c.expected {
+				t.Errorf("expected exit code %d, got %d", c.expected, code)
+			}
+			if stderr.String() != c.stderr {
+				t.Errorf("expected %q on stderr, got %q", c.stderr, stderr.String())
+			}
+
+			request := <-requests
+			if expected := (&messages.Control{Op: messages.ControlWait, Args: []string{"test"}}); !reflect.DeepEqual(request, expected) {
+				t.Errorf("expected request %+v, got %+v", expected, request)
+			}
+		})
+	}
+}
+
+func TestRestartExitCodes(t *testing.T) {
+	cases := []struct {
+		reply    string
+		expected int
+	}{
+		{"OK", 0},
+		{"ERROR: Node not found!: boot", 1},
+	}
+	for _, c := range cases {
+		requests := fakeMaster(t, c.reply)
+		if code := Restart("boot"); code != c.expected {
+			t.Errorf("%q: expected exit code %d, got %d", c.reply, c.expected, code)
+		}
+
+		request := <-requests
+		if expected := (&messages.Control{Op: messages.ControlRestart, Args: []string{"boot"}}); !reflect.DeepEqual(request, expected) {
+			t.Errorf("expected request %+v, got %+v", expected, request)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package zeusclient
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	slog "github.com/burke/zeus/go/shinylog"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+const stopPollInterval = 50 * time.Millisecond
+
+// Stop asks a running master to shut down and waits up to timeout for it
+// to exit. If the master doesn't answer or doesn't exit in time, it is
+// sent SIGTERM and then SIGKILL. Either way, the pid file and socket are
+// removed so that the next start doesn't trip over them. It succeeds if
+// no master was running.
+func Stop(pidFile string, timeout time.Duration) int {
+	pid := readPidFile(pidFile)
+
+	if usock, err := connectToMaster(); err == nil {
+		_, err = controlRequest(usock, messages.ControlStop)
+		usock.Close()
+		if err == nil && waitForMasterExit(pidFile, pid, timeout) {
+			return stopped(pidFile)
+		}
+	}
+
+	if pid <= 0 || !processExists(pid) {
+		// Nothing is running, which is what was asked for.
+		removeStaleFiles(pidFile)
+		println("Zeus doesn't appear to be running; removed any stale " + pidFile + " and socket.")
+		return 0
+	}
+
+	slog.StdErrorString("Zeus didn't stop in time; sending SIGTERM.")
+	syscall.Kill(pid, syscall.SIGTERM)
+	if waitForMasterExit(pidFile, pid, timeout) {
+		return stopped(pidFile)
+	}
+
+	slog.StdErrorString("Zeus still hasn't stopped; sending SIGKILL.")
+	syscall.Kill(pid, syscall.SIGKILL)
+	if waitForMasterExit(pidFile, pid, timeout) {
+		return stopped(pidFile)
+	}
+
+	slog.StdErrorString("Could not stop Zeus process " + strconv.Itoa(pid) + ".")
+	return 1
+}
+
+func stopped(pidFile string) int {
+	removeStaleFiles(pidFile)
+	println("Zeus has stopped.")
+	return 0
+}
+
+func readPidFile(pidFile string) int {
+	pidBytes, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// waitForMasterExit reports whether the master exited before the
+// timeout. The master removes its pid file as the last step of a clean
+// shutdown; without a pid, the socket disappearing is the best we have.
+func waitForMasterExit(pidFile string, pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if pid > 0 {
+			if !fileExists(pidFile) || !processExists(pid) {
+				return true
+			}
+		} else if !fileExists(unixsocket.ZeusSockName()) {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+}
+
+func removeStaleFiles(pidFile string) {
+	os.Remove(pidFile)
+	os.Remove(unixsocket.ZeusSockName())
+	os.Remove(unixsocket.ControlSockName())
+}
+
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,107 @@
+package zeusclient
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+// staleFiles writes a pid file for pid next to the master's socket,
+// and leaves files where the sockets would be if they aren't there,
+// returning the pid file and all three.
+func staleFiles(t *testing.T, pid int) (string, []string) {
+	pidFile := filepath.Join(filepath.Dir(unixsocket.ZeusSockName()), ".zeus.pid")
+	files := []string{pidFile, unixsocket.ZeusSockName(), unixsocket.ControlSockName()}
+	for _, file := range files[1:] {
+		if fileExists(file) {
+			continue
+		}
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pidFile, files
+}
+
+func expectRemoved(t *testing.T, files []string) {
+	t.Helper()
+	for _, file := range files {
+		if fileExists(file) {
+			t.Errorf("expected %s to be removed", file)
+		}
+	}
+}
+
+func TestStopCleansUpAfterDeadMaster(t *testing.T) {
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Fatal(err)
+	}
+	unixsocket.SetZeusSockName(filepath.Join(t.TempDir(), ".zeus.sock"))
+	pidFile, files := staleFiles(t, dead.Process.Pid)
+
+	if code := Stop(pidFile, time.Second); code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	expectRemoved(t, files)
+}
+
+func TestStopSignalsMasterThatDoesNotExit(t *testing.T) {
+	cases := []struct {
+		name     string
+		command  string
+		expected syscall.Signal
+	}{
+		{"SIGTERM", "exec sleep 60", syscall.SIGTERM},
+		{"SIGKILL", `trap "" TERM; exec sleep 60`, syscall.SIGKILL},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			master := exec.Command("sh", "-c", c.command)
+			if err := master.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer master.Process.Kill()
+			// Reap the process as soon as it exits, or it would linger as
+			// a zombie that still looks like it's running.
+			exited := make(chan *os.ProcessState, 1)
+			go func() {
+				master.Wait()
+				exited <- master.ProcessState
+			}()
+			// Give the shell time to ignore SIGTERM.
+			time.Sleep(100 * time.Millisecond)
+
+			// The master says it will stop, but never does.
+			requests := fakeMaster(t, "OK")
+			pidFile, files := staleFiles(t, master.Process.Pid)
+
+			if code := Stop(pidFile, 200*time.Millisecond); code != 0 {
+				t.Errorf("expected exit code 0, got %d", code)
+			}
+			if request := <-requests; request.Op != messages.ControlStop {
+				t.Errorf("expected a stop request, got %+v", request)
+			}
+			select {
+			case state := <-exited:
+				status := state.Sys().(syscall.WaitStatus)
+				if !status.Signaled() || status.Signal() != c.expected {
+					t.Errorf("expected the master to be stopped by %v, got %v", c.expected, state)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected the master to be stopped")
+			}
+			expectRemoved(t, files)
+		})
+	}
+}
@@ -1,16 +1,17 @@
 package zeusclient
 
 import (
+	"errors"
 	"io"
 	"net"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/burke/ttyutils"
 	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/processtree"
 	slog "github.com/burke/zeus/go/shinylog"
 	"github.com/burke/zeus/go/unixsocket"
 	"github.com/burke/zeus/go/zerror"
@@ -26,8 +27,9 @@ const (
 // man signal | grep 'terminate process' | awk '{print $2}' | xargs -I '{}' echo -n "syscall.{}, "
 var terminatingSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGKILL, syscall.SIGPIPE, syscall.SIGALRM, syscall.SIGTERM, syscall.SIGXCPU, syscall.SIGXFSZ, syscall.SIGVTALRM, syscall.SIGPROF, syscall.SIGUSR1, syscall.SIGUSR2}
 
-// Run runs the main Zeus command.
-func Run(args []string, input io.Reader, output *os.File, stderr *os.File, ttyMode string) int {
+// Run runs the main Zeus command. Of the environment variables, only
+// those clientEnv allows are sent, as path.Match patterns.
+func Run(args []string, clientEnv []string, input io.Reader, output *os.File, stderr *os.File, ttyMode string) int {
 	if os.Getenv("RAILS_ENV") != "" {
 		println("Warning: Specifying a Rails environment via RAILS_ENV has no effect for commands run with zeus.")
 		println("As a safety precaution to protect you from nuking your development database,")
@@ -51,22 +53,22 @@ func Run(args []string, input io.Reader, output *os.File, stderr *os.File, ttyMo
 	}
 	defer localStderr.Close()
 
-	addr, err := net.ResolveUnixAddr("unixgram", unixsocket.ZeusSockName())
+	usock, err := dialMaster()
 	if err != nil {
-		slog.ErrorString(err.Error() + "\r")
 		return 1
 	}
 
-	conn, err := net.DialUnix("unix", nil, addr)
+	request := &messages.CommandRequest{Command: args[0], ArgCount: len(args) - 1, Pid: os.Getpid()}
+	if err := messages.Send(usock, usock.codec, request); err != nil {
+		slog.ErrorString(err.Error() + "\r")
+		return 1
+	}
+	err = sendCommandLineArguments(usock.Usock, args)
 	if err != nil {
-		zerror.ErrorCantConnectToMaster()
+		slog.ErrorString(err.Error() + "\r")
 		return 1
 	}
-	usock := unixsocket.New(conn)
-
-	msg := messages.CreateCommandAndArgumentsMessage(args, os.Getpid())
-	usock.WriteMessage(msg)
-	err = sendCommandLineArguments(usock, args)
+	err = sendEnvironment(usock, clientEnv)
 	if err != nil {
 		slog.ErrorString(err.Error() + "\r")
 		return 1
@@ -81,14 +83,9 @@ func Run(args []string, input io.Reader, output *os.File, stderr *os.File, ttyMo
 	remoteStdout.Close()
 	remoteStderr.Close()
 
-	msg, err = usock.ReadMessage()
-	if err != nil {
-		slog.ErrorString(err.Error() + "\r")
-		return 1
-	}
-
-	parts := strings.Split(msg, "\000")
-	commandPid, err := strconv.Atoi(parts[0])
+	var pidMsg messages.CommandPid
+	err = messages.Receive(usock, usock.codec, &pidMsg)
+	commandPid := pidMsg.Pid
 	defer func() {
 		if commandPid > 0 {
 			// Just in case.
@@ -121,15 +118,6 @@ func Run(args []string, input io.Reader, output *os.File, stderr *os.File, ttyMo
 		}()
 	}
 
-	exitStatus := -1
-	if len(parts) > 2 {
-		exitStatus, err = strconv.Atoi(parts[0])
-		if err != nil {
-			slog.ErrorString(err.Error() + "\r")
-			return 1
-		}
-	}
-
 	oldTerminalStateStdout, err := forwardOutput(localStdout, output)
 	if oldTerminalStateStdout != nil {
 		defer ttyutils.RestoreTerminalState(output.Fd(), oldTerminalStateStdout)
@@ -179,18 +167,10 @@ func Run(args []string, input io.Reader, output *os.File, stderr *os.File, ttyMo
 		}
 	}()
 
-	if exitStatus == -1 {
-		msg, err = usock.ReadMessage()
-		if err != nil {
-			slog.ErrorString(err.Error() + "\r")
-			return 1
-		}
-		parts := strings.Split(msg, "\000")
-		exitStatus, err = strconv.Atoi(parts[0])
-		if err != nil {
-			slog.ErrorString(err.Error() + "\r")
-			return 1
-		}
+	var exitStatus messages.ExitStatus
+	if err := messages.Receive(usock, usock.codec, &exitStatus); err != nil {
+		slog.ErrorString(err.Error() + "\r")
+		return 1
 	}
 
 	// Command has exited and reported its status. Clear commandPid so
@@ -199,7 +179,61 @@ func Run(args []string, input io.Reader, output *os.File, stderr *os.File, ttyMo
 	// full buffering). Killing it here loses output.
 	commandPid = 0
 
-	return exitStatus
+	return exitStatus.Code
+}
+
+// dialMaster connects to the master's client socket, reporting any
+// failure to the user.
+func dialMaster() (*masterConn, error) {
+	usock, err := connectToMaster()
+	if err != nil {
+		if _, ok := err.(*net.OpError); ok {
+			zerror.ErrorCantConnectToMaster()
+		} else {
+			slog.ErrorString(err.Error() + "\r")
+		}
+	}
+	return usock, err
+}
+
+// masterConn is a connection to the master's client socket, with the
+// protocol version negotiated for it.
+type masterConn struct {
+	*unixsocket.Usock
+	codec messages.Codec
+}
+
+// connectToMaster connects to the master and negotiates a protocol
+// version. A master that predates negotiation hangs up on the Hello, so
+// in that case we reconnect and speak version 1.
+func connectToMaster() (*masterConn, error) {
+	usock, err := dialSocket()
+	if err != nil {
+		return nil, err
+	}
+	if codec, err := messages.Connect(usock); err == nil {
+		return &masterConn{usock, codec}, nil
+	}
+	usock.Close()
+
+	usock, err = dialSocket()
+	if err != nil {
+		return nil, err
+	}
+	return &masterConn{usock, messages.Legacy}, nil
+}
+
+func dialSocket() (*unixsocket.Usock, error) {
+	addr, err := net.ResolveUnixAddr("unixgram", unixsocket.ZeusSockName())
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialUnix("unix", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return unixsocket.New(conn), nil
 }
 
 func sendCommandLineArguments(usock *unixsocket.Usock, args []string) error {
@@ -231,6 +265,25 @@ func sendCommandLineArguments(usock *unixsocket.Usock, args []string) error {
 	return nil
 }
 
+// sendEnvironment sends the working directory and the environment
+// variables clientEnv allows. Others, such as tokens, never leave the
+// client.
+func sendEnvironment(usock *masterConn, clientEnv []string) error {
+	cwd := unixsocket.StartDir()
+	if cwd == "" {
+		return errors.New("Could not determine the working directory")
+	}
+
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if parts := strings.SplitN(kv, "=", 2); len(parts) == 2 && processtree.ClientEnvAllowed(clientEnv, parts[0]) {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	return messages.Send(usock, usock.codec, &messages.ClientEnvironment{Cwd: cwd, Env: env})
+}
+
 func socketsForOutput(out *os.File, ttyMode string) (local, remote *os.File, outIsTerminal bool, err error) {
 	switch ttyMode {
 	case "force":
@@ -5,12 +5,14 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/burke/zeus/go/clienthandler"
 	"github.com/burke/zeus/go/config"
+	"github.com/burke/zeus/go/controlserver"
 	"github.com/burke/zeus/go/filemonitor"
 	"github.com/burke/zeus/go/processtree"
 	slog "github.com/burke/zeus/go/shinylog"
@@ -27,7 +29,7 @@ var terminatingSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIG
 
 const PidFile = ".zeus.pid"
 
-func Run(configFile string, fileChangeDelay time.Duration, simpleStatus bool) int {
+func Run(configFile string, monitorOptions filemonitor.Options, simpleStatus bool) int {
 	slog.Colorized("{green}Starting {yellow}Z{red}e{blue}u{magenta}s{green} server v" + zeusversion.VERSION)
 
 	zerror.Init()
@@ -39,7 +41,7 @@ func Run(configFile string, fileChangeDelay time.Duration, simpleStatus bool) in
 	signal.Notify(c, syscall.SIGUSR1)
 
 	for {
-		code, restart := runSession(configFile, fileChangeDelay, simpleStatus, c)
+		code, restart := runSession(configFile, monitorOptions, simpleStatus, c)
 		if !restart {
 			slog.Suppress()
 			zerror.PrintFinalOutput()
@@ -54,24 +56,44 @@ func writePidFile() {
 	os.WriteFile(PidFile, []byte(strconv.Itoa(os.Getpid())), 0644)
 }
 
-func runSession(configFile string, fileChangeDelay time.Duration, simpleStatus bool, c <-chan os.Signal) (int, bool) {
-	monitor, err := buildFileMonitor(fileChangeDelay)
+func runSession(configFile string, monitorOptions filemonitor.Options, simpleStatus bool, c <-chan os.Signal) (int, bool) {
+	monitor, err := buildFileMonitor(monitorOptions)
 	if err != nil {
+		slog.Error(err)
 		return 2, false
 	}
 
 	var tree = config.BuildProcessTree(configFile, monitor)
+	monitor.SetIgnore(tree.WatchIgnore)
 
 	done := make(chan bool)
+	stop := make(chan bool, 1)
+	reboot := make(chan bool, 1)
+	configQuit := make(chan bool)
 
-	statusChartQuit := statuschart.Start(tree, done, simpleStatus)
-	clientHandlerQuit := clienthandler.Start(tree, done)
-	slaveMonitorQuit := processtree.StartSlaveMonitor(tree, monitor.Listen(), done)
+	fileChanges := watchConfigFile(configFile, tree, monitor, reboot, configQuit)
+	go checkFileMonitor(tree, monitor, configQuit)
 
-	sig := <-c
+	statusChartQuit := statuschart.Start(tree, done, simpleStatus)
+	clientHandlerQuit := clienthandler.Start(tree, done, stop)
+	controlServerQuit := controlserver.Start(tree, done)
+	slaveMonitorQuit := processtree.StartSlaveMonitor(tree, fileChanges, done)
+
+	var sig os.Signal
+	select {
+	case sig = <-c:
+	case <-stop:
+		// A client asked us to stop; shut down as if interrupted.
+		sig = syscall.SIGINT
+	case <-reboot:
+		// The config changed too much to apply in place.
+		sig = syscall.SIGUSR1
+	}
 
 	// Tear down in reverse startup order
+	close(configQuit)
 	exit(slaveMonitorQuit, done)
+	exit(controlServerQuit, done)
 	exit(clientHandlerQuit, done)
 	monitor.Close()
 	exit(statusChartQuit, done)
@@ -85,6 +107,84 @@ func runSession(configFile string, fileChangeDelay time.Duration, simpleStatus b
 	return 1, false
 }
 
+// watchConfigFile reloads the config file whenever it changes, applying
+// the new plan to the running tree. Changes to other files are passed
+// through on the returned channel. If the new plan can't be applied in
+// place, it signals reboot.
+func watchConfigFile(configFile string, tree *processtree.ProcessTree, monitor filemonitor.FileMonitor, reboot, quit chan bool) <-chan []string {
+	configPath, err := filepath.Abs(configFile)
+	if err != nil {
+		return monitor.Listen()
+	}
+	monitor.Add(configPath)
+	tree.CheckFileMonitor(monitor)
+
+	changes := monitor.Listen()
+	fileChanges := make(chan []string)
+	go func() {
+		for files := range changes {
+			others := make([]string, 0, len(files))
+			for _, file := range files {
+				if file == configPath {
+					// Editors often replace the file rather than writing
+					// to it, which ends the watch.
+					monitor.Add(configPath)
+					tree.CheckFileMonitor(monitor)
+					reloadConfig(configFile, tree, monitor, reboot)
+				} else {
+					others = append(others, file)
+				}
+			}
+			if len(others) == 0 {
+				continue
+			}
+			select {
+			case fileChanges <- others:
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return fileChanges
+}
+
+// fileMonitorCheckInterval is how often checkFileMonitor looks at the
+// file monitor.
+const fileMonitorCheckInterval = time.Second
+
+// checkFileMonitor reports the file monitor becoming degraded while no
+// files are being added to it, as when it loses its connection to
+// watchman, until quit is closed.
+func checkFileMonitor(tree *processtree.ProcessTree, monitor filemonitor.FileMonitor, quit chan bool) {
+	ticker := time.NewTicker(fileMonitorCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			tree.CheckFileMonitor(monitor)
+		}
+	}
+}
+
+func reloadConfig(configFile string, tree *processtree.ProcessTree, monitor filemonitor.FileMonitor, reboot chan bool) {
+	newTree, err := config.LoadProcessTree(configFile, monitor)
+	if err != nil {
+		slog.Red(fmt.Sprintf("Not reloading %s; Zeus is still running the previous plan:\n%v", configFile, err))
+		return
+	}
+	if !tree.ApplyPlan(newTree) {
+		select {
+		case reboot <- true:
+		default:
+		}
+		return
+	}
+	monitor.SetIgnore(newTree.WatchIgnore)
+	slog.Green("Reloaded " + configFile)
+}
+
 func exit(quit, done chan bool) {
 	// Signal the process to quit.
 	close(quit)
@@ -92,7 +192,7 @@ func exit(quit, done chan bool) {
 	<-done
 }
 
-func buildFileMonitor(fileChangeDelay time.Duration) (filemonitor.FileMonitor, error) {
+func buildFileMonitor(opts filemonitor.Options) (filemonitor.FileMonitor, error) {
 	if portStr := os.Getenv(listenerPortVar); portStr != "" {
 		port, err := strconv.Atoi(portStr)
 		if err != nil {
@@ -107,13 +207,8 @@ func buildFileMonitor(fileChangeDelay time.Duration) (filemonitor.FileMonitor, e
 			return nil, err
 		}
 
-		return filemonitor.NewFileListener(fileChangeDelay, ln), nil
-	}
-
-	monitor, err := filemonitor.NewFileMonitor(fileChangeDelay)
-	if err != nil {
-		return nil, err
+		return filemonitor.NewFileListener(opts.FileChangeDelay, ln), nil
 	}
 
-	return monitor, nil
+	return filemonitor.New(opts)
 }
@@ -2,21 +2,26 @@ package zeusmaster_test
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/burke/zeus/go/filemonitor"
+	"github.com/burke/zeus/go/processtree"
 	slog "github.com/burke/zeus/go/shinylog"
 	"github.com/burke/zeus/go/unixsocket"
 	"github.com/burke/zeus/go/zeusclient"
 	"github.com/burke/zeus/go/zeusmaster"
+	"github.com/burke/zeus/go/zeusslave"
 )
 
 var testFiles = map[string]string{
@@ -150,6 +155,10 @@ func enableTracing() {
 }
 
 func TestZeusBoots(t *testing.T) {
+	if _, err := exec.LookPath("ruby"); err != nil {
+		t.Skip("ruby is not installed; TestZeusRunsGoSlave covers the master without it")
+	}
+
 	dir, err := ioutil.TempDir("", "zeus_test")
 	if err != nil {
 		t.Fatal(err)
@@ -197,7 +206,7 @@ func TestZeusBoots(t *testing.T) {
 	enableTracing()
 	zexit := make(chan int)
 	go func() {
-		zexit <- zeusmaster.Run(filepath.Join(dir, "zeus.json"), filemonitor.DefaultFileChangeDelay, false)
+		zexit <- zeusmaster.Run(filepath.Join(dir, "zeus.json"), filemonitor.Options{FileChangeDelay: filemonitor.DefaultFileChangeDelay}, false)
 	}()
 
 	expects := map[string]string{
@@ -252,7 +261,7 @@ func TestZeusBoots(t *testing.T) {
 
 	cexit := make(chan int, 1)
 	go func() {
-		cexit <- zeusclient.Run([]string{"cmd"}, hangingReader{readCloser}, cmdWriter, cmdErrWriter)
+		cexit <- zeusclient.Run([]string{"cmd"}, nil, hangingReader{readCloser}, cmdWriter, cmdErrWriter, "auto")
 		time.Sleep(100 * time.Millisecond)
 		cmdWriter.Close()
 		cmdErrWriter.Close()
@@ -308,3 +317,180 @@ func (r hangingReader) Read([]byte) (int, error) {
 	<-r.close
 	return 0, io.EOF
 }
+
+// The test binary runs itself as the slave for TestZeusRunsGoSlave;
+// this variable tells it to.
+const slaveTestVar = "ZEUSMASTER_TEST_SLAVE"
+
+var greeting string
+
+var goSlavePlan = &zeusslave.Plan{
+	Actions: map[string]func() error{
+		"boot": func() error { return nil },
+		"child": func() error {
+			data, err := os.ReadFile("greeting.txt")
+			if err != nil {
+				return err
+			}
+			greeting = strings.TrimSpace(string(data))
+			return zeusslave.AddFeature("greeting.txt")
+		},
+	},
+	Commands: map[string]func([]string) int{
+		"greet": func(args []string) int {
+			fmt.Println(greeting, strings.Join(args, " "))
+			fmt.Fprintln(os.Stderr, "greeted")
+			return 3
+		},
+	},
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(slaveTestVar) != "" {
+		if err := zeusslave.Run(goSlavePlan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// TestZeusRunsGoSlave runs the master against the Go reference slave,
+// so the master's side of the protocol is tested without Ruby.
+func TestZeusRunsGoSlave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zeus_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf(`{"command": %q, "plan": {"boot": {"child": {"greet": []}}}}`, executable)
+	files := map[string]string{"zeus.json": config, "greeting.txt": "hello\n"}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	unixsocket.SetZeusSockName(filepath.Join(dir, ".zeus.sock"))
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	// The master passes its environment on to the root process.
+	t.Setenv(slaveTestVar, "1")
+
+	me, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zexit := make(chan int)
+	go func() {
+		zexit <- zeusmaster.Run(filepath.Join(dir, "zeus.json"), filemonitor.Options{FileChangeDelay: filemonitor.DefaultFileChangeDelay}, true)
+	}()
+	defer func() {
+		// The zeusmaster catches the interrupt and exits gracefully
+		me.Signal(os.Interrupt)
+		if code := <-zexit; code != 0 {
+			t.Errorf("Zeus exited with %d", code)
+		}
+	}()
+
+	// Both slaves register, and the child is spawned from the root.
+	nodes := waitForNodes(t, func(nodes map[string]processtree.NodeStatus) bool {
+		return nodes["child"].State == "ready"
+	})
+	boot, child := nodes["boot"], nodes["child"]
+	if boot.State != "ready" || boot.Pid == 0 || child.Pid == 0 || child.Parent != "boot" {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+
+	if stdout, stderr, code := runCommand(t, "greet", "world"); stdout != "hello world\n" || stderr != "greeted\n" || code != 3 {
+		t.Fatalf("expected greet to print %q and %q and exit 3; got %q, %q, and %d", "hello world\n", "greeted\n", stdout, stderr, code)
+	}
+
+	// The child reported greeting.txt as a feature, so changing it
+	// restarts the child, but not the root.
+	if err := ioutil.WriteFile(filepath.Join(dir, "greeting.txt"), []byte("hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes = waitForNodes(t, func(nodes map[string]processtree.NodeStatus) bool {
+		return nodes["child"].State == "ready" && nodes["child"].Pid != child.Pid
+	})
+	if nodes["boot"].Pid != boot.Pid {
+		t.Errorf("expected boot to keep running as pid %d, but it restarted as %d", boot.Pid, nodes["boot"].Pid)
+	}
+	if restart := nodes["child"].LastRestart; restart == nil || len(restart.Files) != 1 || filepath.Base(restart.Files[0]) != "greeting.txt" {
+		t.Errorf("expected child to restart for greeting.txt, got %+v", restart)
+	}
+
+	if stdout, _, code := runCommand(t, "greet", "again"); stdout != "hi again\n" || code != 3 {
+		t.Errorf("expected greet to print %q and exit 3 after the restart; got %q and %d", "hi again\n", stdout, code)
+	}
+}
+
+// waitForNodes polls the master's status until done is true of its
+// nodes, keyed by name, and returns them.
+func waitForNodes(t *testing.T, done func(map[string]processtree.NodeStatus) bool) map[string]processtree.NodeStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var out bytes.Buffer
+		if zeusclient.Status(&out, true) == 0 {
+			var status processtree.TreeStatus
+			if err := json.Unmarshal(out.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			nodes := make(map[string]processtree.NodeStatus)
+			for _, node := range status.Nodes {
+				nodes[node.Name] = node
+			}
+			if done(nodes) {
+				return nodes
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the nodes; last saw %+v", nodes)
+			}
+		} else if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the master to start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// runCommand runs a command as the client would, returning its output
+// and exit status.
+func runCommand(t *testing.T, args ...string) (string, string, int) {
+	t.Helper()
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdoutR.Close()
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderrR.Close()
+
+	// Input never ends: once Run returns, the client has closed the
+	// socket it would forward input to.
+	code := zeusclient.Run(args, nil, hangingReader{make(chan struct{})}, stdoutW, stderrW, "auto")
+	stdoutW.Close()
+	stderrW.Close()
+
+	stdout, err := ioutil.ReadAll(stdoutR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := ioutil.ReadAll(stderrR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(stdout), string(stderr), code
+}
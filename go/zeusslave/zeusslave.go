@@ -0,0 +1,467 @@
+// Package zeusslave implements the slave side of the protocol in Go.
+// It is a reference for slave libraries in other languages, and lets the
+// protocol be tested without Ruby.
+//
+// Go programs can't fork, so where the Ruby gem forks a booted process,
+// this package starts the program again instead, and the new process
+// runs the actions of the nodes above it before its own. The master sees
+// the same messages either way, but nothing is saved by checkpointing.
+//
+// See docs/master_slave_handshake.md, docs/client_master_handshake.md,
+// and docs/message_format.md.
+package zeusslave
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/unixsocket"
+)
+
+// A Plan maps the names in the config's plan to the code they run.
+type Plan struct {
+	// Root names the node the master starts. Defaults to "boot".
+	Root string
+
+	// Actions boot each node, keyed by name. A node whose action
+	// returns an error is marked crashed, with the error as its message.
+	Actions map[string]func() error
+
+	// Commands run each command, keyed by name, with the client's
+	// arguments, and return its exit status.
+	Commands map[string]func(args []string) int
+}
+
+// Variables the master, or a slave, sets for the processes it starts.
+const (
+	masterFDVar  = "ZEUS_MASTER_FD"
+	nodePathVar  = "ZEUS_NODE_PATH"
+	parentPidVar = "ZEUS_PARENT_PID"
+	commandVar   = "ZEUS_COMMAND"
+	runnerFDVar  = "ZEUS_RUNNER_FD"
+	versionVar   = "ZEUS_PROTOCOL_VERSION"
+	dirVar       = "ZEUS_COMMAND_DIR"
+)
+
+var internalVars = []string{masterFDVar, nodePathVar, parentPidVar, commandVar, runnerFDVar, versionVar, dirVar}
+
+// Run plays the part the master, or the slave that started this process,
+// asked for. A slave runs until the master hangs up, so Run only returns
+// early if something goes wrong. A process started to run a command
+// exits with the command's status.
+func Run(plan *Plan) error {
+	switch {
+	case os.Getenv(runnerFDVar) != "":
+		return runCommandRunner()
+	case os.Getenv(commandVar) != "":
+		os.Exit(runCommand(plan))
+	}
+	return runSlave(plan)
+}
+
+var (
+	featureMu   sync.Mutex
+	featurePipe *os.File
+)
+
+// AddFeature tells the master this node depends on a file, so that the
+// node is restarted when the file changes. It does nothing in commands.
+func AddFeature(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	featureMu.Lock()
+	defer featureMu.Unlock()
+	if featurePipe == nil {
+		return nil
+	}
+	_, err = featurePipe.WriteString(path + "\n")
+	return err
+}
+
+func runSlave(plan *Plan) error {
+	fd, err := strconv.Atoi(os.Getenv(masterFDVar))
+	if err != nil {
+		return fmt.Errorf("zeusslave: %s is not set; run this program from zeus", masterFDVar)
+	}
+	masterFile := os.NewFile(uintptr(fd), "master")
+	master, err := unixsocket.NewFromFile(masterFile)
+	if err != nil {
+		return err
+	}
+
+	path, err := nodePath(plan)
+	if err != nil {
+		return err
+	}
+	parentPid, _ := strconv.Atoi(os.Getenv(parentPidVar))
+
+	// Give the master a socket to talk to us on, and identify ourselves
+	// on it.
+	local, remote, err := unixsocket.Socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		return err
+	}
+	err = master.WriteFD(int(remote.Fd()))
+	remote.Close()
+	if err != nil {
+		return err
+	}
+	usock, err := unixsocket.NewFromFile(local)
+	local.Close()
+	if err != nil {
+		return err
+	}
+	defer usock.Close()
+
+	codec, err := messages.Connect(usock)
+	if err != nil {
+		return err
+	}
+	pidMsg := &messages.Pid{Pid: os.Getpid(), ParentPid: parentPid, Identifier: path[len(path)-1]}
+	if err := messages.Send(usock, codec, pidMsg); err != nil {
+		return err
+	}
+
+	featuresR, featuresW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	err = usock.WriteFD(int(featuresR.Fd()))
+	featuresR.Close()
+	if err != nil {
+		return err
+	}
+	featureMu.Lock()
+	featurePipe = featuresW
+	featureMu.Unlock()
+
+	// Replay the actions of the nodes above us, then run our own.
+	result := "OK"
+	actionErr := runActions(plan, path)
+	if actionErr != nil {
+		result = actionErr.Error()
+	}
+	if err := messages.Send(usock, codec, &messages.ActionResponse{Result: result}); err != nil {
+		return err
+	}
+	if actionErr != nil {
+		return actionErr
+	}
+
+	// We are now connected, and start nodes and commands on request.
+	for {
+		msg, err := usock.ReadMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var slave messages.SpawnSlave
+		var command messages.SpawnCommand
+		if codec.Decode(msg, &slave) == nil {
+			err = spawnSlave(masterFile, path, &slave)
+		} else if codec.Decode(msg, &command) == nil {
+			err = spawnCommand(usock, codec, path, &command)
+		} else {
+			err = fmt.Errorf("zeusslave: unexpected message: %s", msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// nodePath lists the node this process runs and the nodes above it,
+// from the root down.
+func nodePath(plan *Plan) ([]string, error) {
+	value := os.Getenv(nodePathVar)
+	if value == "" {
+		root := plan.Root
+		if root == "" {
+			root = "boot"
+		}
+		return []string{root}, nil
+	}
+
+	var path []string
+	if err := json.Unmarshal([]byte(value), &path); err != nil || len(path) == 0 {
+		return nil, fmt.Errorf("zeusslave: malformed %s: %q", nodePathVar, value)
+	}
+	return path, nil
+}
+
+func runActions(plan *Plan, path []string) error {
+	for _, name := range path {
+		action := plan.Actions[name]
+		if action == nil {
+			return fmt.Errorf("zeusslave: no action for %s", name)
+		}
+		if err := action(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func spawnSlave(masterFile *os.File, path []string, msg *messages.SpawnSlave) error {
+	childPath, _ := json.Marshal(append(path[:len(path):len(path)], msg.Identifier))
+
+	cmd, err := restart(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	cmd.Env = environ(msg.Env, map[string]string{
+		masterFDVar:  "3",
+		nodePathVar:  string(childPath),
+		parentPidVar: strconv.Itoa(os.Getpid()),
+	})
+	cmd.ExtraFiles = []*os.File{masterFile}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// spawnCommand starts a runner for the command, which hands the master
+// a socket of its own and takes over from there.
+func spawnCommand(usock *unixsocket.Usock, codec messages.Codec, path []string, msg *messages.SpawnCommand) error {
+	local, remote, err := unixsocket.Socketpair(syscall.SOCK_DGRAM)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	nodes, _ := json.Marshal(path)
+	cmd, err := restart(os.Args[1:])
+	if err != nil {
+		local.Close()
+		return err
+	}
+	cmd.Env = environ(msg.Env, map[string]string{
+		runnerFDVar:  "3",
+		commandVar:   msg.Identifier,
+		nodePathVar:  string(nodes),
+		parentPidVar: strconv.Itoa(os.Getpid()),
+		versionVar:   strconv.Itoa(codec.Version()),
+	})
+	cmd.ExtraFiles = []*os.File{local}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	local.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	return usock.WriteFD(int(remote.Fd()))
+}
+
+// runCommandRunner receives the client's arguments, environment, and
+// terminal from the master, starts the command with them, and reports
+// its pid and exit status.
+func runCommandRunner() error {
+	fd, _ := strconv.Atoi(os.Getenv(runnerFDVar))
+	file := os.NewFile(uintptr(fd), "runner")
+	usock, err := unixsocket.NewFromFile(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	defer usock.Close()
+
+	version, _ := strconv.Atoi(os.Getenv(versionVar))
+	codec, err := messages.CodecForVersion(version)
+	if err != nil {
+		return err
+	}
+
+	var request messages.PidAndArguments
+	if err := messages.Receive(usock, codec, &request); err != nil {
+		return err
+	}
+	args, err := receiveArguments(usock, request.ArgCount)
+	if err != nil {
+		return err
+	}
+	stdout, err := receiveFile(usock, "stdout")
+	if err != nil {
+		return err
+	}
+	stderr, err := receiveFile(usock, "stderr")
+	if err != nil {
+		stdout.Close()
+		return err
+	}
+
+	cmd, err := restart(args)
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return err
+	}
+	cmd.Env = environ(request.Env, map[string]string{
+		commandVar:  os.Getenv(commandVar),
+		nodePathVar: os.Getenv(nodePathVar),
+		dirVar:      request.Cwd,
+	})
+	cmd.Stdin = stdout
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Start()
+	stdout.Close()
+	stderr.Close()
+	if err != nil {
+		return err
+	}
+
+	parentPid, _ := strconv.Atoi(os.Getenv(parentPidVar))
+	if err := messages.Send(usock, codec, &messages.Pid{Pid: cmd.Process.Pid, ParentPid: parentPid}); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	go killCommandIfClientQuits(cmd.Process, request.Pid)
+
+	cmd.Wait()
+	code := cmd.ProcessState.ExitCode()
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		// Report a command killed by a signal as a shell would.
+		code = 128 + int(status.Signal())
+	}
+	return messages.Send(usock, codec, &messages.ExitStatus{Code: code})
+}
+
+// restart prepares to run this program again, in place of a fork.
+func restart(args []string) (*exec.Cmd, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	return exec.Command(executable, args...), nil
+}
+
+func receiveFile(usock *unixsocket.Usock, name string) (*os.File, error) {
+	fd, err := usock.ReadFD()
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// receiveArguments reads the client's arguments, each terminated by a
+// NUL, from a file the master passes on from the client.
+func receiveArguments(usock *unixsocket.Usock, count int) ([]string, error) {
+	file, err := receiveFile(usock, "arguments")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	if len(data) > 0 {
+		args = strings.Split(strings.TrimSuffix(string(data), "\000"), "\000")
+	}
+	if len(args) != count {
+		return nil, fmt.Errorf("zeusslave: argument count mismatch: expected %d, got %d", count, len(args))
+	}
+	return args, nil
+}
+
+func killCommandIfClientQuits(command *os.Process, clientPid int) {
+	for {
+		if err := syscall.Kill(clientPid, 0); errors.Is(err, syscall.ESRCH) {
+			command.Kill()
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// runCommand runs in the process started for a command: it replays the
+// actions of the command's node and those above it, then runs the
+// command.
+func runCommand(plan *Plan) int {
+	name := os.Getenv(commandVar)
+	path, err := nodePath(plan)
+	if err == nil {
+		err = runActions(plan, path)
+	}
+	// Importing unixsocket moves us to the project root, as it does the
+	// master and slaves, so change to the client's directory here.
+	if dir := os.Getenv(dirVar); err == nil && dir != "" {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	command := plan.Commands[name]
+	if command == nil {
+		fmt.Fprintf(os.Stderr, "zeusslave: no command %s\n", name)
+		return 1
+	}
+	for _, key := range internalVars {
+		os.Unsetenv(key)
+	}
+	return command(os.Args[1:])
+}
+
+// environ returns this process's environment without the variables
+// used to set up slaves, with vars and then internal added.
+func environ(vars, internal map[string]string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if _, ok := vars[key]; ok || isInternal(key) {
+			continue
+		}
+		env = append(env, kv)
+	}
+
+	for _, set := range []map[string]string{vars, internal} {
+		keys := make([]string, 0, len(set))
+		for key := range set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			env = append(env, key+"="+set[key])
+		}
+	}
+	return env
+}
+
+func isInternal(key string) bool {
+	for _, internal := range internalVars {
+		if key == internal {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package zeusslave_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/burke/zeus/go/messages"
+	"github.com/burke/zeus/go/unixsocket"
+	"github.com/burke/zeus/go/zeusslave"
+)
+
+// The test binary runs itself as the slave; this variable tells it to.
+const slaveTestVar = "ZEUSSLAVE_TEST"
+
+var booted []string
+
+var testPlan = &zeusslave.Plan{
+	Actions: map[string]func() error{
+		"boot": func() error {
+			booted = append(booted, "boot")
+			return zeusslave.AddFeature(os.Getenv("ZEUSSLAVE_TEST_FEATURE"))
+		},
+		"child": func() error {
+			booted = append(booted, "child")
+			return nil
+		},
+		"broken": func() error {
+			return errors.New("broken on purpose")
+		},
+	},
+	Commands: map[string]func([]string) int{
+		"echo": func(args []string) int {
+			cwd, _ := os.Getwd()
+			fmt.Println(strings.Join(booted, ","), strings.Join(args, " "))
+			fmt.Fprintln(os.Stderr, os.Getenv("GREETING"), os.Getenv("SEED"), cwd)
+			return 3
+		},
+	},
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(slaveTestVar) != "" {
+		if err := zeusslave.Run(testPlan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeMaster plays the master's part: slaves register on its socket,
+// and it drives them with messages.
+type fakeMaster struct {
+	t    *testing.T
+	sock *unixsocket.Usock
+	pids []int
+}
+
+func startSlave(t *testing.T, env ...string) *fakeMaster {
+	local, remote, err := unixsocket.Socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock, err := unixsocket.NewFromFile(local)
+	local.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), append(env, slaveTestVar+"=1", "ZEUS_MASTER_FD=3")...)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	remote.Close()
+
+	m := &fakeMaster{t: t, sock: sock}
+	t.Cleanup(func() {
+		for _, pid := range m.pids {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		sock.Close()
+	})
+	return m
+}
+
+// register accepts the next slave to register, returning its socket and
+// the codec it negotiated, its Pid message, and its feature pipe.
+func (m *fakeMaster) register() (*unixsocket.Usock, messages.Codec, *messages.Pid, *os.File) {
+	m.sock.SetReadDeadline(time.Now().Add(10 * time.Second))
+	fd, err := m.sock.ReadFD()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	file := os.NewFile(uintptr(fd), "slave")
+	usock, err := unixsocket.NewFromFile(file)
+	file.Close()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	m.t.Cleanup(usock.Close)
+	usock.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	codec, msg, err := messages.Accept(usock)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	var pid messages.Pid
+	if err := codec.Decode(msg, &pid); err != nil {
+		m.t.Fatal(err)
+	}
+	m.pids = append(m.pids, pid.Pid)
+
+	featureFD, err := usock.ReadFD()
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	features := os.NewFile(uintptr(featureFD), "features")
+	m.t.Cleanup(func() { features.Close() })
+	return usock, codec, &pid, features
+}
+
+func expectResult(t *testing.T, usock *unixsocket.Usock, codec messages.Codec, want string) {
+	t.Helper()
+	var response messages.ActionResponse
+	if err := messages.Receive(usock, codec, &response); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(response.Result, want) {
+		t.Fatalf("expected action response %q, got %q", want, response.Result)
+	}
+}
+
+func TestBootReportsFeatures(t *testing.T) {
+	feature := filepath.Join(t.TempDir(), "boot.rb")
+	if err := os.WriteFile(feature, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := startSlave(t, "ZEUSSLAVE_TEST_FEATURE="+feature)
+	usock, codec, pid, features := m.register()
+	if codec.Version() != messages.ProtocolVersion {
+		t.Errorf("expected protocol version %d, got %d", messages.ProtocolVersion, codec.Version())
+	}
+	if pid.Identifier != "boot" || pid.ParentPid != 0 {
+		t.Errorf("unexpected registration %+v", pid)
+	}
+	expectResult(t, usock, codec, "OK")
+
+	buf := make([]byte, len(feature)+1)
+	if _, err := io.ReadFull(features, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != feature+"\n" {
+		t.Errorf("expected feature %q, got %q", feature, buf)
+	}
+}
+
+func TestSpawnSlaveAndRunCommand(t *testing.T) {
+	m := startSlave(t)
+	root, codec, rootPid, _ := m.register()
+	expectResult(t, root, codec, "OK")
+
+	spawn := &messages.SpawnSlave{Identifier: "child", Env: map[string]string{"GREETING": "hello"}}
+	if err := messages.Send(root, codec, spawn); err != nil {
+		t.Fatal(err)
+	}
+	child, codec, childPid, _ := m.register()
+	if childPid.Identifier != "child" || childPid.ParentPid != rootPid.Pid {
+		t.Fatalf("unexpected registration %+v", childPid)
+	}
+	expectResult(t, child, codec, "OK")
+
+	if err := messages.Send(child, codec, &messages.SpawnCommand{Identifier: "echo"}); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := child.ReadFD()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := os.NewFile(uintptr(fd), "command")
+	command, err := unixsocket.NewFromFile(file)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer command.Close()
+	command.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	// Play the client: send the arguments and two terminals.
+	dir := t.TempDir()
+	request := &messages.PidAndArguments{Pid: os.Getpid(), ArgCount: 2, Cwd: dir, Env: map[string]string{"SEED": "1234"}}
+	if err := messages.Send(command, codec, request); err != nil {
+		t.Fatal(err)
+	}
+	argsR, argsW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	argsW.WriteString("spec/a_spec.rb\000--fail-fast\000")
+	argsW.Close()
+	sendFile(t, command, argsR)
+
+	stdout := sendSocket(t, command)
+	stderr := sendSocket(t, command)
+
+	var pid messages.Pid
+	if err := messages.Receive(command, codec, &pid); err != nil {
+		t.Fatal(err)
+	}
+	if pid.Pid <= 0 || pid.ParentPid != childPid.Pid {
+		t.Errorf("unexpected command pid %+v", pid)
+	}
+
+	if out, _ := io.ReadAll(stdout); string(out) != "boot,child spec/a_spec.rb --fail-fast\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if out, _ := io.ReadAll(stderr); string(out) != "hello 1234 "+dir+"\n" {
+		t.Errorf("unexpected error output %q", out)
+	}
+
+	var status messages.ExitStatus
+	if err := messages.Receive(command, codec, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Code != 3 {
+		t.Errorf("expected exit status 3, got %d", status.Code)
+	}
+}
+
+func TestActionError(t *testing.T) {
+	m := startSlave(t)
+	root, codec, _, _ := m.register()
+	expectResult(t, root, codec, "OK")
+
+	if err := messages.Send(root, codec, &messages.SpawnSlave{Identifier: "broken"}); err != nil {
+		t.Fatal(err)
+	}
+	broken, codec, _, _ := m.register()
+	expectResult(t, broken, codec, "broken on purpose")
+}
+
+func sendFile(t *testing.T, usock *unixsocket.Usock, file *os.File) {
+	t.Helper()
+	defer file.Close()
+	if err := usock.WriteFD(int(file.Fd())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sendSocket sends one end of a new socket pair, returning the other.
+func sendSocket(t *testing.T, usock *unixsocket.Usock) *os.File {
+	t.Helper()
+	local, remote, err := unixsocket.Socketpair(syscall.SOCK_STREAM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { local.Close() })
+	sendFile(t, usock, remote)
+	return local
+}
@@ -0,0 +1 @@
+BOOTED = True
@@ -0,0 +1 @@
+LOADED_BY = "child"
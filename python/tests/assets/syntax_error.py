@@ -0,0 +1,3 @@
+# Imported by the broken_import node to check that the file with the
+# error is reported, though it never finishes loading.
+def broken(:
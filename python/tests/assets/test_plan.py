@@ -0,0 +1,37 @@
+import os
+import sys
+
+import zeus
+
+
+class TestPlan(zeus.Plan):
+    booted = []
+
+    def boot(self):
+        from assets import boot_module  # noqa: F401
+        zeus.add_feature(os.path.join(os.path.dirname(__file__), "boot_data.txt"))
+        self.booted.append("boot")
+
+    def child(self):
+        from assets import child_module  # noqa: F401
+        self.booted.append("child")
+
+    def broken_import(self):
+        from assets import syntax_error  # noqa: F401
+
+    def echo(self):
+        print(",".join(self.booted), " ".join(sys.argv[1:]))
+        print(os.environ.get("GREETING"), os.environ.get("SEED"), os.getcwd(), file=sys.stderr)
+        sys.exit(3)
+
+    def succeed(self):
+        pass
+
+    def exit_message(self):
+        sys.exit("no tests given")
+
+    def crash(self):
+        raise RuntimeError("crashed on purpose")
+
+
+zeus.plan = TestPlan()
@@ -0,0 +1,253 @@
+import json
+import os
+import select
+import socket
+import subprocess
+import sys
+import tempfile
+import unittest
+
+TESTS = os.path.dirname(os.path.abspath(__file__))
+ASSETS = os.path.join(TESTS, "assets")
+
+
+class FakeMaster:
+    """Runs assets/test_plan.py with ``python -m zeus``, as zeus.json's
+    command would, and accepts its nodes as they register. The tests
+    play the master by hand, so they can watch what the library itself
+    does: the files its import hook reports, and the exit status it makes
+    of a command's SystemExit."""
+
+    def __init__(self, test):
+        self.sock, remote = socket.socketpair(socket.AF_UNIX, socket.SOCK_STREAM)
+        self.sock.settimeout(10)
+        env = dict(os.environ, ZEUS_MASTER_FD=str(remote.fileno()))
+        env["PYTHONPATH"] = os.pathsep.join([os.path.dirname(TESTS), TESTS])
+        self.process = subprocess.Popen(
+            [sys.executable, "-m", "zeus", "assets.test_plan"],
+            cwd=TESTS, env=env, pass_fds=[remote.fileno()])
+        remote.close()
+        test.addCleanup(self.close)
+        self.test = test
+        self.pids = []
+
+    def close(self):
+        for pid in self.pids:
+            try:
+                os.kill(pid, 9)
+            except ProcessLookupError:
+                pass
+        self.process.kill()
+        self.process.wait()
+        self.sock.close()
+
+    def register(self):
+        """Accepts the next slave to register, returning its connection,
+        its pid message, and its feature pipe."""
+        conn = Connection(recv_socket(self.sock, socket.SOCK_STREAM))
+        self.test.addCleanup(conn.sock.close)
+        hello = conn.receive()
+        assert hello == {"type": "hello", "version": 2}, hello
+        conn.send(hello)
+        pid = conn.receive()
+        self.pids.append(pid["pid"])
+        features = FeaturePipe(conn.receive_fd())
+        self.test.addCleanup(features.close)
+        return conn, pid, features
+
+
+class FeaturePipe:
+    """Reads the paths a node reports, one per line."""
+
+    def __init__(self, fd):
+        self.fd = fd
+        self.buffer = b""
+        self.seen = set()
+
+    def close(self):
+        os.close(self.fd)
+
+    def wait_for(self, path):
+        """Reads until path is reported, returning everything reported so
+        far."""
+        while path not in self.seen:
+            if not select.select([self.fd], [], [], 10)[0]:
+                raise AssertionError("%s was never reported; got %s" % (path, sorted(self.seen)))
+            data = os.read(self.fd, 1 << 16)
+            if not data:
+                raise AssertionError("The feature pipe closed before %s was reported; got %s" % (path, sorted(self.seen)))
+            self.buffer += data
+            *lines, self.buffer = self.buffer.split(b"\n")
+            self.seen.update(line.decode() for line in lines)
+        return self.seen
+
+
+class Connection:
+    def __init__(self, sock):
+        self.sock = sock
+        self.sock.settimeout(10)
+        self.buffer = b""
+        self.fds = []
+
+    def send(self, message):
+        self.sock.sendall(json.dumps(message).encode() + b"\0")
+
+    def receive(self):
+        # Each descriptor is sent with a NUL, which reads as an empty
+        # message.
+        self.buffer = self.buffer.lstrip(b"\0")
+        while b"\0" not in self.buffer:
+            data, fds, _, _ = socket.recv_fds(self.sock, 1 << 16, 4)
+            if not data:
+                raise EOFError
+            self.buffer += data
+            self.fds += fds
+            self.buffer = self.buffer.lstrip(b"\0")
+        message, _, self.buffer = self.buffer.partition(b"\0")
+        return json.loads(message)
+
+    def receive_fd(self):
+        """Returns the next file descriptor sent, which may have arrived
+        with an earlier message."""
+        if not self.fds:
+            data, self.fds, _, _ = socket.recv_fds(self.sock, 1, 1)
+            self.buffer += data
+        return self.fds.pop(0)
+
+
+def recv_fd(sock):
+    _, fds, _, _ = socket.recv_fds(sock, 1, 1)
+    return fds[0]
+
+
+def recv_socket(sock, kind):
+    return socket.socket(socket.AF_UNIX, kind, fileno=recv_fd(sock))
+
+
+def asset(name):
+    return os.path.join(ASSETS, name)
+
+
+class ZeusTest(unittest.TestCase):
+    def test_boot_reports_imports(self):
+        master = FakeMaster(self)
+        root, root_pid, root_features = master.register()
+        self.assertEqual(root_pid["identifier"], "boot")
+        self.assertEqual(root.receive(), {"type": "action_response", "result": "OK"})
+
+        # The plan is imported before the pipe exists, so its files are
+        # held until the node registers.
+        reported = root_features.wait_for(asset("boot_data.txt"))
+        self.assertIn(asset("test_plan.py"), reported)
+        self.assertIn(asset("boot_module.py"), reported)
+
+        # A forked node reports its own imports on its own pipe.
+        root.send({"type": "spawn_slave", "identifier": "child"})
+        child, _, child_features = master.register()
+        self.assertEqual(child.receive()["result"], "OK")
+        child_features.wait_for(asset("child_module.py"))
+
+    def test_failed_import_reports_file(self):
+        master = FakeMaster(self)
+        root, _, _ = master.register()
+        root.receive()
+
+        root.send({"type": "spawn_slave", "identifier": "broken_import"})
+        broken, _, features = master.register()
+        result = broken.receive()["result"]
+        self.assertIn("SyntaxError", result)
+        # The master must watch the file, or fixing it wouldn't restart
+        # the node.
+        features.wait_for(asset("syntax_error.py"))
+
+    def test_command_sees_client_arguments_and_environment(self):
+        master = FakeMaster(self)
+        child, _ = self.boot_child(master, env={"GREETING": "hello"})
+
+        cwd = tempfile.mkdtemp()
+        self.addCleanup(os.rmdir, cwd)
+        stdout, stderr, code = self.run_command(
+            master, child, "echo", ["tests/test_a.py", "--exitfirst"],
+            cwd=cwd, env={"SEED": "1234"})
+        self.assertEqual(stdout, b"boot,child tests/test_a.py --exitfirst\n")
+        self.assertEqual(stderr, ("hello 1234 %s\n" % os.path.realpath(cwd)).encode())
+        self.assertEqual(code, 3)
+
+    def test_command_exit_status(self):
+        master = FakeMaster(self)
+        child, _ = self.boot_child(master)
+
+        with self.subTest("returns"):
+            _, stderr, code = self.run_command(master, child, "succeed")
+            self.assertEqual((stderr, code), (b"", 0))
+        with self.subTest("exits with a message"):
+            # As the interpreter would: the message goes to stderr, and
+            # the status is 1.
+            _, stderr, code = self.run_command(master, child, "exit_message")
+            self.assertEqual((stderr, code), (b"no tests given\n", 1))
+        with self.subTest("raises"):
+            _, stderr, code = self.run_command(master, child, "crash")
+            self.assertIn(b"RuntimeError: crashed on purpose", stderr)
+            self.assertEqual(code, 1)
+
+    def boot_child(self, master, env=None):
+        """Registers the boot node and forks the child node from it,
+        returning the child's connection and pid message."""
+        root, _, _ = master.register()
+        root.receive()
+        root.send({"type": "spawn_slave", "identifier": "child", "env": env or {}})
+        child, child_pid, _ = master.register()
+        self.assertEqual(child.receive()["result"], "OK")
+        return child, child_pid
+
+    def run_command(self, master, node, identifier, args=(), cwd=None, env=None):
+        """Plays the client for a command forked from node, returning its
+        stdout, its stderr, and its exit status."""
+        node.send({"type": "spawn_command", "identifier": identifier})
+        command = Connection(socket.socket(socket.AF_UNIX, socket.SOCK_DGRAM, fileno=node.receive_fd()))
+
+        command.send({"type": "pid_and_arguments", "pid": os.getpid(), "arg_count": len(args),
+                      "cwd": cwd or TESTS, "env": env or {}})
+        args_r, args_w = os.pipe()
+        os.write(args_w, b"".join(arg.encode() + b"\0" for arg in args))
+        os.close(args_w)
+        send_fd(command.sock, args_r)
+        stdout = send_socket(self, command.sock)
+        stderr = send_socket(self, command.sock)
+
+        pid = command.receive()
+        self.assertEqual(pid["type"], "pid")
+        master.pids.append(pid["pid"])
+
+        output = read_all(stdout), read_all(stderr)
+        status = command.receive()
+        self.assertEqual(status["type"], "exit_status")
+        command.sock.close()
+        return output + (status["code"],)
+
+
+def send_fd(sock, fd):
+    socket.send_fds(sock, [b"\0"], [fd])
+    os.close(fd)
+
+
+def send_socket(test, sock):
+    """Sends one end of a new socket pair, returning the other."""
+    local, remote = socket.socketpair(socket.AF_UNIX, socket.SOCK_STREAM)
+    local.settimeout(10)
+    test.addCleanup(local.close)
+    send_fd(sock, remote.detach())
+    return local
+
+
+def read_all(sock):
+    data = b""
+    while True:
+        chunk = sock.recv(1 << 16)
+        if not chunk:
+            return data
+        data += chunk
+
+
+if __name__ == "__main__":
+    unittest.main()
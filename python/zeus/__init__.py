@@ -0,0 +1,271 @@
+"""The slave side of Zeus for Python.
+
+Set ``zeus.plan`` to an instance of a ``Plan`` subclass with a method for
+each node and command in zeus.json, then call ``zeus.go()``; or run
+``python -m zeus <module>`` with a module that sets the plan. See
+docs/master_slave_handshake.md and docs/client_master_handshake.md for
+the protocol this implements.
+"""
+
+import json
+import os
+import signal
+import socket
+import sys
+import threading
+import time
+import traceback
+
+from zeus import load_tracking
+from zeus.load_tracking import add_feature
+from zeus.plan import Plan
+
+__all__ = ["Plan", "add_feature", "go", "plan"]
+
+PROTOCOL_VERSION = 2
+
+plan = None
+
+_master_socket = None
+_parent_pid = None
+
+
+def go(identifier="boot"):
+    """Boots the node named identifier, then forks nodes and commands as
+    the master asks for them. Thanks to fork, this returns once in each
+    command runner, after its command has finished."""
+    load_tracking.install()
+    run_command = _boot_steps(identifier)
+    if run_command:
+        _command(*run_command)
+
+
+def _setup_master_socket():
+    global _master_socket
+    if _master_socket is None:
+        fd = int(os.environ["ZEUS_MASTER_FD"])
+        _master_socket = socket.socket(fileno=fd)
+    return _master_socket
+
+
+def _boot_steps(identifier):
+    global _parent_pid
+
+    while True:
+        master = _setup_master_socket()
+        feature_pipe_r, feature_pipe_w = os.pipe()
+
+        # I need to give the master a way to talk to me exclusively
+        local, remote = socket.socketpair(socket.AF_UNIX, socket.SOCK_STREAM)
+        _send_io(master, remote.fileno())
+        remote.close()
+        conn = _Connection(local)
+        conn.negotiate()
+
+        # Now I need to tell the master about my PID and ID
+        conn.send("pid", pid=os.getpid(), parent_pid=_parent_pid or 0, identifier=identifier)
+        _send_io(local, feature_pipe_r)
+        os.close(feature_pipe_r)
+
+        load_tracking.set_feature_pipe(os.fdopen(feature_pipe_w, "w"))
+        if _parent_pid is None:
+            # A plan run as a script isn't imported, so isn't tracked,
+            # but the whole tree depends on it.
+            plan_file = getattr(sys.modules.get(type(plan).__module__), "__file__", None)
+            if plan_file:
+                add_feature(plan_file)
+
+        _run_action(conn, identifier)
+
+        # We are now 'connected'. From this point, we may receive requests to fork.
+        children = set()
+        next_identifier = None
+        while next_identifier is None:
+            message = conn.receive()
+            if message is None:
+                # The master has gone away.
+                sys.exit(0)
+            if message["type"] not in ("spawn_slave", "spawn_command"):
+                raise RuntimeError("Unexpected message from the master: %r" % message)
+
+            # Reap any child runners or slaves that might have exited in
+            # the meantime.
+            for pid in list(children):
+                if os.waitpid(pid, os.WNOHANG)[0]:
+                    children.discard(pid)
+
+            forked_from = os.getpid()
+            pid = os.fork()
+            if pid:
+                # We're in the parent. Record the child:
+                children.add(pid)
+                continue
+
+            _parent_pid = forked_from
+            os.environ.update(message.get("env") or {})
+            load_tracking.clear_feature_pipe()
+
+            if message["type"] == "spawn_slave":
+                # Child, supposed to start another step:
+                local.close()
+                next_identifier = message["identifier"]
+            else:
+                # Child, supposed to run a command:
+                return message["identifier"], conn
+        identifier = next_identifier
+
+
+def _run_action(conn, identifier):
+    # Now we run the action and report its success/fail status to the master.
+    try:
+        def action():
+            if identifier != "boot":
+                plan.after_fork()
+            getattr(plan, identifier)()
+        load_tracking.track_features_loaded_by(action)
+        conn.send("action_response", result="OK")
+    except BaseException:
+        conn.send("action_response", result=traceback.format_exc())
+        raise
+
+
+def _command(identifier, conn):
+    client_pid = None
+    try:
+        os.setsid()
+
+        local, remote = socket.socketpair(socket.AF_UNIX, socket.SOCK_DGRAM)
+        _send_io(conn.sock, remote.fileno())
+        remote.close()
+        conn.sock.close()
+        conn = _Connection(local)
+
+        request = conn.receive("pid_and_arguments")
+        client_pid = request["pid"]
+        with os.fdopen(_recv_io(local), "rb") as arg_io:
+            data = arg_io.read()
+        arguments = [arg.decode() for arg in data.rstrip(b"\0").split(b"\0")] if data else []
+
+        if len(arguments) != request["arg_count"]:
+            raise RuntimeError("Argument count mismatch: Expected %d, got %d" % (request["arg_count"], len(arguments)))
+
+        pid = os.fork()
+        if pid == 0:
+            code = 1
+            try:
+                plan.after_fork()
+                remote_stdin_stdout = _recv_io(local)
+                remote_stderr = _recv_io(local)
+                conn.send("pid", pid=os.getpid(), parent_pid=_parent_pid, identifier="")
+                local.close()
+
+                os.dup2(remote_stdin_stdout, 0)
+                os.dup2(remote_stdin_stdout, 1)
+                os.dup2(remote_stderr, 2)
+                if request.get("cwd"):
+                    os.chdir(request["cwd"])
+                os.environ.update(request.get("env") or {})
+                sys.argv[1:] = arguments
+
+                code = _run_command(identifier)
+            finally:
+                os._exit(code)
+
+        _kill_command_if_client_quits(pid, client_pid)
+
+        _, status = os.waitpid(pid, 0)
+        code = os.waitstatus_to_exitcode(status)
+        if code < 0:
+            # Report a command killed by a signal as a shell would.
+            code = 128 - code
+
+        conn.send("exit_status", code=code)
+        local.close()
+    except BaseException:
+        # If anything at all went wrong, kill the client - if anything
+        # went wrong before the runner can clean up, it might hang
+        # around forever.
+        if client_pid:
+            os.kill(client_pid, signal.SIGTERM)
+        raise
+
+
+def _run_command(identifier):
+    try:
+        getattr(plan, identifier)()
+        code = 0
+    except SystemExit as exit:
+        if exit.code is None or isinstance(exit.code, int):
+            code = exit.code or 0
+        else:
+            print(exit.code, file=sys.stderr)
+            code = 1
+    except BaseException:
+        traceback.print_exc()
+        code = 1
+    sys.stdout.flush()
+    sys.stderr.flush()
+    return code
+
+
+def _kill_command_if_client_quits(command_pid, client_pid):
+    def watch():
+        while True:
+            try:
+                os.kill(client_pid, 0)
+            except ProcessLookupError:
+                os.kill(command_pid, signal.SIGKILL)
+                os._exit(0)
+            time.sleep(1)
+    threading.Thread(target=watch, daemon=True).start()
+
+
+def _send_io(sock, fd):
+    socket.send_fds(sock, [b"\0"], [fd])
+
+
+def _recv_io(sock):
+    _, fds, _, _ = socket.recv_fds(sock, 1, 1)
+    if not fds:
+        raise RuntimeError("Expected a file descriptor, none received")
+    return fds[0]
+
+
+class _Connection:
+    """Sends and receives messages on a socket to the master: JSON
+    objects, each terminated by a NUL. See docs/message_format.md."""
+
+    def __init__(self, sock):
+        self.sock = sock
+        self.buffer = b""
+
+    def negotiate(self):
+        self.send("hello", version=PROTOCOL_VERSION)
+        version = self.receive("hello")["version"]
+        if version != PROTOCOL_VERSION:
+            raise RuntimeError("The master chose protocol version %d; this library speaks %d" % (version, PROTOCOL_VERSION))
+
+    def send(self, type, **fields):
+        message = json.dumps(dict(type=type, **fields)).encode() + b"\0"
+        self.sock.sendall(message)
+
+    def receive(self, expected=None):
+        """Returns the next message, or None if the master hung up."""
+        while True:
+            message, sep, rest = self.buffer.partition(b"\0")
+            if sep:
+                self.buffer = rest
+                if not message:
+                    continue
+                break
+            data = self.sock.recv(1 << 16)
+            if not data:
+                if expected:
+                    raise EOFError("Expected a %s message, but the master hung up" % expected)
+                return None
+            self.buffer += data
+
+        message = json.loads(message)
+        if expected and message.get("type") != expected:
+            raise RuntimeError("Wrong message type! Expected %s message, got: %r" % (expected, message))
+        return message
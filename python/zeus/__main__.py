@@ -0,0 +1,19 @@
+"""Runs a plan: ``python -m zeus custom_plan`` imports custom_plan from
+the current directory, which should set ``zeus.plan``, and boots it."""
+
+import importlib
+import os
+import sys
+
+import zeus
+
+if len(sys.argv) < 2:
+    sys.exit("usage: python -m zeus <plan module>")
+
+sys.path.insert(0, os.getcwd())
+zeus.load_tracking.install()
+module = sys.argv.pop(1)
+importlib.import_module(module)
+if zeus.plan is None:
+    sys.exit("%s didn't set zeus.plan" % module)
+zeus.go()
@@ -0,0 +1,108 @@
+"""Reports the files a slave loads to the master over the feature pipe,
+so that the slave is restarted when any of them change.
+
+Imports are tracked by a finder at the front of ``sys.meta_path``, which
+asks the other finders for each module and notes where it came from.
+Other files, like settings or templates read at boot, can be reported
+with ``add_feature``.
+"""
+
+import importlib.abc
+import os
+import sys
+import threading
+import traceback
+
+_lock = threading.Lock()
+_feature_pipe = None
+# Files loaded before the first node boots, like the plan's imports, are
+# held until it can report them.
+_pending = []
+
+
+def add_feature(path):
+    """Tells the master the current node depends on a file."""
+    full_path = os.path.abspath(path)
+    if os.path.exists(full_path):
+        _notify_features([full_path])
+
+
+def track_features_loaded_by(action):
+    """Runs action, reporting the files in the traceback if it raises:
+    the cause may be in a file that was already loaded."""
+    try:
+        return action()
+    except BaseException as err:
+        _notify_features(_traceback_files(err))
+        raise
+
+
+def set_feature_pipe(feature_pipe):
+    """Internal: This should only be called by Zeus code"""
+    global _feature_pipe, _pending
+    with _lock:
+        _feature_pipe = feature_pipe
+        features, _pending = _pending, None
+    if features:
+        _notify_features(features)
+
+
+def clear_feature_pipe():
+    """Internal: This should only be called by Zeus code"""
+    global _feature_pipe
+    with _lock:
+        if _feature_pipe is not None:
+            try:
+                _feature_pipe.close()
+            except OSError:
+                pass
+        _feature_pipe = None
+
+
+def _notify_features(features):
+    with _lock:
+        if _feature_pipe is None:
+            if _pending is not None:
+                _pending.extend(features)
+            return
+        try:
+            for feature in features:
+                _feature_pipe.write(feature + "\n")
+            _feature_pipe.flush()
+        except (OSError, ValueError):
+            # The feature pipe is broken; skip tracking. This must not
+            # raise, or it would replace the exception being reported.
+            pass
+
+
+def _traceback_files(err):
+    files = []
+    for frame in traceback.extract_tb(err.__traceback__):
+        if os.path.isabs(frame.filename) and not frame.filename.startswith(_zeus_dir):
+            files.append(frame.filename)
+    # A SyntaxError's file isn't in the traceback, only the error.
+    if isinstance(err, SyntaxError) and err.filename and os.path.isabs(err.filename):
+        files.append(err.filename)
+    return files
+
+
+_zeus_dir = os.path.dirname(os.path.abspath(__file__)) + os.sep
+
+
+class _TrackingFinder(importlib.abc.MetaPathFinder):
+    def find_spec(self, fullname, path, target=None):
+        for finder in sys.meta_path:
+            if finder is self or not hasattr(finder, "find_spec"):
+                continue
+            spec = finder.find_spec(fullname, path, target)
+            if spec is not None:
+                if spec.has_location and spec.origin:
+                    add_feature(spec.origin)
+                return spec
+        return None
+
+
+def install():
+    """Starts tracking imports. Safe to call more than once."""
+    if not any(isinstance(finder, _TrackingFinder) for finder in sys.meta_path):
+        sys.meta_path.insert(0, _TrackingFinder())
@@ -0,0 +1,8 @@
+class Plan:
+    """Subclass with a method named for each node and command in the
+    config's plan. Node methods boot the application in stages; command
+    methods run in a fork of their node, with sys.argv set to the
+    client's arguments."""
+
+    def after_fork(self):
+        """Runs in each forked node and command before its method."""
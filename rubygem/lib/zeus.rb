@@ -86,7 +86,8 @@ module Zeus
               children.delete(pid) if Process.waitpid(pid, Process::WNOHANG)
             end
 
-            messages.split("\0").each do |new_identifier|
+            messages.split("\0").each do |message|
+              new_identifier, *env = message.split("\n")
               new_identifier =~ /^(.):(.*)/
               code, ident = $1, $2
 
@@ -99,6 +100,7 @@ module Zeus
               elsif code == "S"
                 # Child, supposed to start another step:
                 @parent_pid = forked_from
+                apply_env(env)
 
                 Zeus::LoadTracking.clear_feature_pipe
 
@@ -106,6 +108,7 @@ module Zeus
               else
                 # Child, supposed to run a command:
                 @parent_pid = forked_from
+                apply_env(env)
 
                 Zeus::LoadTracking.clear_feature_pipe
 
@@ -129,8 +132,10 @@ module Zeus
       remote.close
       sock.close
 
-      pid_and_argument_count = local.recv(2**16)
-      pid_and_argument_count.chomp("\0") =~ /(.*?):(.*)/
+      # The pid and argument count may be followed by the client's
+      # working directory and environment variables, one per line.
+      pid_and_argument_count, cwd, *env = local.recv(2**16).chomp("\0").split("\n")
+      pid_and_argument_count =~ /(.*?):(.*)/
       client_pid, argument_count = $1.to_i, $2.to_i
       arg_io = local.recv_io
       arguments = arg_io.read.chomp("\0").split("\0")
@@ -151,6 +156,8 @@ module Zeus
         $stdin.reopen(remote_stdin_stdout)
         $stdout.reopen(remote_stdin_stdout)
         $stderr.reopen(remote_stderr)
+        Dir.chdir(unescape(cwd)) if cwd && !cwd.empty?
+        apply_env(env)
         ARGV.replace(arguments)
 
         plan.send(identifier)
@@ -171,6 +178,20 @@ module Zeus
       Process.kill(:TERM, client_pid)
     end
 
+    # Environment variables for a new step or command follow the spawn
+    # message, and for a command's client the pid and argument count,
+    # one KEY=VALUE per line, with backslashes and newlines escaped.
+    def apply_env(lines)
+      lines.each do |line|
+        key, value = line.split("=", 2)
+        ENV[key] = unescape(value)
+      end
+    end
+
+    def unescape(value)
+      value.gsub(/\\(.)/) { $1 == "n" ? "\n" : $1 }
+    end
+
     def kill_command_if_client_quits!(command_pid, client_pid)
       Thread.new {
         loop {
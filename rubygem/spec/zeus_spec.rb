@@ -82,4 +82,19 @@ describe Zeus do
     it 'tracks features after booting has completed' do
     end
   end
+
+  context 'environment from spawn messages' do
+    around do |example|
+      saved = ENV.to_h
+      example.run
+      ENV.replace(saved)
+    end
+
+    it 'sets each variable, unescaping values' do
+      Zeus.send(:apply_env, ['RAILS_ENV=test', 'MULTILINE=one\ntwo\\\\n', 'EMPTY='])
+      expect(ENV['RAILS_ENV']).to eq('test')
+      expect(ENV['MULTILINE']).to eq("one\ntwo\\n")
+      expect(ENV['EMPTY']).to eq('')
+    end
+  end
 end